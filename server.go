@@ -1,58 +1,85 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"errors"
+	"log"
+	"myapp/src/config"
+	"myapp/src/connection"
 	"myapp/src/lobby"
+	"myapp/src/protocol"
+	"myapp/src/router"
 	"myapp/src/types"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
-// Update the upgrader to be more secure and configurable
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		// TODO: Make this configurable via environment variable
-		allowedOrigins := []string{"http://localhost:8080", "http://localhost:3000"}
-		origin := r.Header.Get("Origin")
-		for _, allowed := range allowedOrigins {
-			if origin == allowed {
-				return true
+// newUpgrader only accepts websocket connections from the configured origins.
+// Clients pick JSON or binary messages with Sec-WebSocket-Protocol.
+func newUpgrader(allowedOrigins []string) websocket.Upgrader {
+	return websocket.Upgrader{
+		Subprotocols: protocol.Subprotocols,
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			for _, allowed := range allowedOrigins {
+				if origin == allowed {
+					return true
+				}
 			}
-		}
-		return false
-	},
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+			return false
+		},
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+	}
+}
+
+type server struct {
+	config   config.Config
+	upgrader websocket.Upgrader
+	router   *router.Router
 }
 
 func main() {
-	lobby.StartLobbyCleanupTicker()
-	lobby.GameTick()
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+
+	lobby.Configure(cfg.Game)
+
+	s := &server{
+		config:   cfg,
+		upgrader: newUpgrader(cfg.Server.AllowedOrigins),
+	}
+	s.router = s.newRouter()
+
 	e := echo.New()
 	e.Debug = true
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
-	e.Static("/", "../public")
-	e.GET("/ws", connect)
-	e.Logger.Fatal(e.Start(":3000"))
+	e.Static("/", cfg.Server.StaticDir)
+	e.GET("/ws", s.connect)
+	e.GET("/api/lobbies", lobby.ListLobbiesHTTP)
+	e.Logger.Fatal(e.Start(cfg.Server.Address))
 
 }
 
 // Connect function
-func connect(c echo.Context) error {
+func (s *server) connect(c echo.Context) error {
 	// WebSocket upgrade and other setup code...
-	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	ws, err := s.upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
 		return err
 	}
-	defer ws.Close()
+	conn := connection.New(ws, s.config.Connection)
+	defer conn.Close(websocket.CloseNormalClosure, "")
+	defer lobby.Disconnect(conn)
 
 	for {
-		_, msg, err := ws.ReadMessage()
+		messageType, msg, err := ws.ReadMessage()
 		if err != nil {
 			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
 				return nil
@@ -60,97 +87,117 @@ func connect(c echo.Context) error {
 			return err
 		}
 
-		// TODO: ping pong - handle concurrent websocket write issue caused by pong response.
-		// if messageType == websocket.TextMessage && string(msg) == "ping" {
-		// 	err = ws.WriteMessage(websocket.TextMessage, []byte("pong"))
-		// 	if err != nil {
-		// 		c.Logger().Error("Error sending pong:", err)
-		// 	}
-		// 	continue
-		// }
-
-		var request types.FrontendRequest
-		if err := json.Unmarshal(msg, &request); err != nil {
-			continue
-		}
-
-		// Check if data is of type map[string]interface{}.
-		requestData, ok := request.Data.(map[string]interface{})
-		if !ok && request.Data != nil {
-			c.Logger().Error("Data not of expected type.", nil)
-			fmt.Printf("%T\n", request.Data)
-			continue
+		if messageType == websocket.BinaryMessage {
+			err = s.router.ServeBinary(c, conn, msg)
+		} else {
+			err = s.router.Serve(c, conn, msg)
 		}
-
-		switch request.ID {
-		case "create_game":
-			// Handle other types similarly based on different IDs
-			if err := lobby.CreateGame(c, ws, requestData); err != nil {
-				handleErrorAndCloseConnection(c, ws, err)
-				return nil
-			}
-		case "join_game":
-			// Handle other types similarly based on different IDs
-			if err := lobby.JoinGame(c, ws, requestData); err != nil {
-				handleErrorAndCloseConnection(c, ws, err)
-				return nil
-			}
-		case "player_update_position":
-			// Handle other types similarly based on different IDs
-			if err := lobby.PlayerUpdatePosition(c, ws, requestData, request.Token); err != nil {
-				handleErrorAndCloseConnection(c, ws, err)
-				return nil
-			}
-		case "player_shoot_projectile":
-			// Handle other types similarly based on different IDs
-			if err := lobby.PlayerShootProjectile(c, ws, requestData, request.Token); err != nil {
-				handleErrorAndCloseConnection(c, ws, err)
-				return nil
-			}
-		default:
-			fmt.Println("Unhandled ID")
+		if err != nil {
+			handleErrorAndCloseConnection(c, conn, err)
+			return nil
 		}
 	}
 }
 
-func handleErrorAndCloseConnection(c echo.Context, ws *websocket.Conn, err error) {
+func handleErrorAndCloseConnection(c echo.Context, conn *connection.SafeConnection, err error) {
 	if err == nil {
 		return
 	}
 	c.Logger().Error(err)
-	closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, err.Error())
-	if closeErr := ws.WriteMessage(websocket.CloseMessage, closeMessage); closeErr != nil {
-		c.Logger().Error("Error sending close message:", closeErr)
-	}
-	if closeErr := ws.Close(); closeErr != nil {
-		c.Logger().Error("Error closing WebSocket:", closeErr)
+	closeCode := websocket.CloseNormalClosure
+	var requestErr *types.RequestError
+	if errors.As(err, &requestErr) {
+		switch requestErr.Code {
+		case types.BadRequest:
+			closeCode = websocket.CloseProtocolError
+		case types.UnsupportedVersion:
+			closeCode = protocol.CloseUnsupportedVersion
+		default:
+			closeCode = websocket.ClosePolicyViolation
+		}
 	}
+	conn.Close(closeCode, err.Error())
 }
 
-type RequestHandler func(echo.Context, *websocket.Conn, map[string]interface{}) error
+func (s *server) newRouter() *router.Router {
+	cfg := s.config.Server
+	r := router.New()
+	r.Use(router.Recover(), router.Logger(), router.RateLimit(cfg.RateLimit, cfg.RateBurst))
+	if cfg.RequireHello {
+		r.Use(router.RequireHello("hello"))
+	}
 
-var handlers = map[string]RequestHandler{
-	"create_game": lobby.CreateGame,
-	"join_game":   lobby.JoinGame,
-	// "player_update_position":  lobby.PlayerUpdatePosition,
-	// "player_shoot_projectile": lobby.PlayerShootProjectile,
-	// Add other handlers here
+	router.Handle(r, "hello", s.hello)
+
+	router.Handle(r, "create_game", lobby.CreateGame)
+	router.Handle(r, "join_game", lobby.JoinGame)
+	router.Handle(r, "list_lobbies", lobby.ListLobbies)
+	r.HandleFunc("unsubscribe_lobbies", lobby.UnsubscribeLobbies)
+	r.HandleFunc("authenticate", lobby.Authenticate)
+	r.HandleFunc("resume_session", lobby.ResumeSession)
+	r.HandleFunc("leave_game", lobby.LeaveGame, router.RequireAuth())
+	router.Handle(r, "update_settings", lobby.UpdateSettings, router.RequireAuth())
+	router.Handle(r, "set_ready", lobby.SetReady, router.RequireAuth())
+	r.HandleFunc("rematch", lobby.Rematch, router.RequireAuth())
+	router.Handle(r, "player_update_position", lobby.PlayerUpdatePosition, router.RequireAuth())
+	router.Handle(r, "player_shoot_projectile", lobby.PlayerShootProjectile, router.RequireAuth())
+	router.Handle(r, "switch_weapon", lobby.SwitchWeapon, router.RequireAuth())
+	r.HandleFunc("reload", lobby.Reload, router.RequireAuth())
+	router.Handle(r, "snapshot_ack", lobby.SnapshotAck, router.RequireAuth())
+	r.HandleFunc("request_keyframe", lobby.RequestKeyframe, router.RequireAuth())
+
+	router.HandleBinary(r, protocol.OpPlayerInput, "player_update_position", lobby.DecodePlayerInput)
+	router.HandleBinary(r, protocol.OpShootProjectile, "player_shoot_projectile", lobby.DecodeShootRequest)
+	router.HandleBinary(r, protocol.OpSnapshotAck, "snapshot_ack", lobby.DecodeSnapshotAck)
+	router.HandleBinary(r, protocol.OpRequestKeyframe, "request_keyframe", lobby.DecodeEmpty)
+	return r
 }
 
-func handleWebSocketRequest(c echo.Context, ws *websocket.Conn, request types.FrontendRequest) {
-	handler, found := handlers[request.ID]
-	if !found {
-		fmt.Println("Unhandled ID")
-		return
-	}
+type HelloRequest struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+}
 
-	requestData, ok := request.Data.(map[string]interface{})
-	if !ok && request.Data != nil {
-		c.Logger().Error("Data not of expected type.", nil)
-		return
-	}
+type Welcome struct {
+	Version      int      `json:"version"`
+	MinVersion   int      `json:"minVersion"`
+	Protocol     string   `json:"protocol"`
+	TickRate     float64  `json:"tickRate"` // Game updates per second
+	StepsPerTick int      `json:"stepsPerTick"`
+	WorldWidth   float64  `json:"worldWidth"`
+	WorldHeight  float64  `json:"worldHeight"`
+	Features     []string `json:"features"`
+}
 
-	if err := handler(c, ws, requestData); err != nil {
-		handleErrorAndCloseConnection(c, ws, err)
+// hello checks that the client speaks a protocol version the server
+// understands and tells it how the server is set up.
+func (s *server) hello(ctx *router.Context, request HelloRequest) error {
+	if request.Version < protocol.MinVersion || request.Version > protocol.Version {
+		return types.NewError(types.UnsupportedVersion, "protocol version %d is not supported, the server speaks %d to %d",
+			request.Version, protocol.MinVersion, protocol.Version)
+	}
+	features := protocol.Negotiate(request.Features)
+	ctx.Conn.SetHandshake(connection.Handshake{
+		Version:  request.Version,
+		Features: features,
+	})
+
+	game := s.config.Game
+	subprotocol := protocol.JSON
+	if ctx.Conn.Binary() {
+		subprotocol = protocol.Binary
 	}
+	return ctx.Reply(types.FrontendResponse{
+		ID: "welcome",
+		Data: Welcome{
+			Version:      protocol.Version,
+			MinVersion:   protocol.MinVersion,
+			Protocol:     subprotocol,
+			TickRate:     float64(time.Second) / float64(game.TickInterval.Duration),
+			StepsPerTick: game.StepsPerTick,
+			WorldWidth:   game.WorldWidth,
+			WorldHeight:  game.WorldHeight,
+			Features:     features,
+		},
+	})
 }
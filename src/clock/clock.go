@@ -0,0 +1,111 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for the simulation, so that it can be driven
+// manually instead of by the wall clock.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the wall clock.
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t realTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// Manual only moves when Advance is called. Its tickers fire as Advance
+// passes their deadlines; like time.Ticker, ticks that are not received in
+// time are dropped.
+type Manual struct {
+	mutex   sync.Mutex
+	now     time.Time
+	tickers []*manualTicker
+}
+
+func NewManual(start time.Time) *Manual {
+	return &Manual{now: start}
+}
+
+func (m *Manual) Now() time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.now
+}
+
+func (m *Manual) NewTicker(d time.Duration) Ticker {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	t := &manualTicker{
+		clock:    m,
+		c:        make(chan time.Time, 1),
+		interval: d,
+		next:     m.now.Add(d),
+	}
+	m.tickers = append(m.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward and fires any tickers that became due.
+func (m *Manual) Advance(d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.now = m.now.Add(d)
+	for _, t := range m.tickers {
+		for !t.next.After(m.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.interval)
+		}
+	}
+}
+
+type manualTicker struct {
+	clock    *Manual
+	c        chan time.Time
+	interval time.Duration
+	next     time.Time
+}
+
+func (t *manualTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *manualTicker) Stop() {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	for i, other := range t.clock.tickers {
+		if other == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			break
+		}
+	}
+}
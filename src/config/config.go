@@ -0,0 +1,418 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"myapp/src/protocol"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Duration is a time.Duration that reads from strings such as "16ms" in JSON.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+type Config struct {
+	Server     ServerConfig     `json:"server"`
+	Connection ConnectionConfig `json:"connection"`
+	Game       GameConfig       `json:"game"`
+}
+
+type ServerConfig struct {
+	Address        string   `json:"address"`
+	AllowedOrigins []string `json:"allowedOrigins"`
+	StaticDir      string   `json:"staticDir"`
+	// Messages per second each connection may send, with bursts up to RateBurst
+	RateLimit float64 `json:"rateLimit"`
+	RateBurst int     `json:"rateBurst"`
+	// Refuse every message until the client has sent hello
+	RequireHello bool `json:"requireHello"`
+}
+
+type ConnectionConfig struct {
+	QueueSize  int      `json:"queueSize"`
+	MaxLag     Duration `json:"maxLag"`
+	WriteWait  Duration `json:"writeWait"`
+	PingPeriod Duration `json:"pingPeriod"`
+	PongWait   Duration `json:"pongWait"`
+}
+
+type SpawnPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// Weapon describes a gun players can switch to. A Damage or ProjectileSpeed
+// of zero takes the lobby's gameplay setting instead; other values are scaled
+// by how far a lobby's setting is from the server's.
+type Weapon struct {
+	Name            string   `json:"name"`
+	FireRate        float64  `json:"fireRate"` // Shots per second
+	ProjectileSpeed float64  `json:"projectileSpeed"`
+	Damage          float64  `json:"damage"`
+	Spread          float64  `json:"spread"` // Largest deviation from the aim in radians
+	MagazineSize    int      `json:"magazineSize"`
+	ReloadTime      Duration `json:"reloadTime"`
+}
+
+type GameConfig struct {
+	// The lobby loop wakes every TickInterval, runs StepsPerTick fixed
+	// simulation steps and then broadcasts the state
+	TickInterval         Duration `json:"tickInterval"`
+	StepsPerTick         int      `json:"stepsPerTick"`
+	WorldWidth           float64  `json:"worldWidth"`
+	WorldHeight          float64  `json:"worldHeight"`
+	Acceleration         float64  `json:"acceleration"`
+	Smoothing            float64  `json:"smoothing"`
+	Damage               float64  `json:"damage"`
+	MaxHealth            float64  `json:"maxHealth"`
+	ProjectileSpeed      float64  `json:"projectileSpeed"`
+	PlayerRadius         float64  `json:"playerRadius"`
+	ProjectileRadius     float64  `json:"projectileRadius"`
+	MaxRewind            Duration `json:"maxRewind"`
+	KeyframeInterval     Duration `json:"keyframeInterval"`
+	ReconnectGracePeriod Duration `json:"reconnectGracePeriod"`
+	LobbyIdleTimeout     Duration `json:"lobbyIdleTimeout"`
+	// Default capacity of new lobbies
+	MaxPlayers int `json:"maxPlayers"`
+
+	// Players spawn at whichever point is farthest from their enemies. A dead
+	// player respawns after RespawnDelay, and can't be hit for SpawnProtection
+	// afterwards unless they fire.
+	SpawnPoints     []SpawnPoint `json:"spawnPoints"`
+	RespawnDelay    Duration     `json:"respawnDelay"`
+	SpawnProtection Duration     `json:"spawnProtection"`
+
+	// Players start with the first weapon
+	Weapons []Weapon `json:"weapons"`
+
+	// A match counts down once MinPlayers are connected, and all of them are
+	// ready if RequireReady is set. It ends at TimeLimit or when a player
+	// reaches ScoreLimit, zero meaning no limit, and shows the results for
+	// ResultsDuration before the lobby closes unless a rematch is started.
+	MinPlayers        int      `json:"minPlayers"`
+	RequireReady      bool     `json:"requireReady"`
+	CountdownDuration Duration `json:"countdownDuration"`
+	TimeLimit         Duration `json:"timeLimit"`
+	ScoreLimit        int      `json:"scoreLimit"`
+	ResultsDuration   Duration `json:"resultsDuration"`
+	// How recently a player must have damaged someone to share in their kill
+	AssistWindow Duration `json:"assistWindow"`
+}
+
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			Address:        ":3000",
+			AllowedOrigins: []string{"http://localhost:8080", "http://localhost:3000"},
+			StaticDir:      "../public",
+			RateLimit:      120,
+			RateBurst:      240,
+		},
+		Connection: ConnectionConfig{
+			QueueSize:  64,
+			MaxLag:     Duration{2 * time.Second},
+			WriteWait:  Duration{10 * time.Second},
+			PingPeriod: Duration{5 * time.Second},
+			PongWait:   Duration{15 * time.Second},
+		},
+		Game: GameConfig{
+			TickInterval:         Duration{16 * time.Millisecond},
+			StepsPerTick:         1,
+			WorldWidth:           2560,
+			WorldHeight:          1440,
+			Acceleration:         33.0,
+			Smoothing:            5.0,
+			Damage:               10.0,
+			MaxHealth:            100,
+			ProjectileSpeed:      13.0,
+			PlayerRadius:         20.0,
+			ProjectileRadius:     5.0,
+			MaxRewind:            Duration{250 * time.Millisecond},
+			KeyframeInterval:     Duration{2 * time.Second},
+			ReconnectGracePeriod: Duration{30 * time.Second},
+			LobbyIdleTimeout:     Duration{10 * time.Minute},
+			MaxPlayers:           8,
+			MinPlayers:           2,
+			RequireReady:         true,
+			CountdownDuration:    Duration{5 * time.Second},
+			TimeLimit:            Duration{5 * time.Minute},
+			ScoreLimit:           10,
+			ResultsDuration:      Duration{15 * time.Second},
+			AssistWindow:         Duration{10 * time.Second},
+			RespawnDelay:         Duration{3 * time.Second},
+			SpawnProtection:      Duration{2 * time.Second},
+			SpawnPoints: []SpawnPoint{
+				{X: 500, Y: 500}, {X: 2060, Y: 500}, {X: 1280, Y: 720},
+				{X: 500, Y: 940}, {X: 2060, Y: 940},
+			},
+			Weapons: []Weapon{
+				{Name: "blaster", FireRate: 5, Spread: 0.02, MagazineSize: 12, ReloadTime: Duration{1500 * time.Millisecond}},
+				{Name: "rifle", FireRate: 1.5, ProjectileSpeed: 24, Damage: 35, MagazineSize: 5, ReloadTime: Duration{2500 * time.Millisecond}},
+				{Name: "smg", FireRate: 12, ProjectileSpeed: 15, Damage: 5, Spread: 0.12, MagazineSize: 30, ReloadTime: Duration{2 * time.Second}},
+			},
+		},
+	}
+}
+
+// Load builds the configuration from the defaults, then the JSON file named by
+// CONFIG_FILE if set, then individual environment variables.
+func Load() (Config, error) {
+	// A missing .env file is fine, the variables may come from the environment
+	_ = godotenv.Load()
+
+	cfg := Default()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("reading config file: %v", err)
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("parsing config file %s: %v", path, err)
+		}
+	}
+
+	if err := applyEnv(&cfg); err != nil {
+		return cfg, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func applyEnv(cfg *Config) error {
+	stringValues := map[string]*string{
+		"ADDRESS":    &cfg.Server.Address,
+		"STATIC_DIR": &cfg.Server.StaticDir,
+	}
+	for name, target := range stringValues {
+		if value, ok := os.LookupEnv(name); ok {
+			*target = value
+		}
+	}
+
+	if value, ok := os.LookupEnv("PORT"); ok {
+		cfg.Server.Address = ":" + value
+	}
+	bools := map[string]*bool{
+		"REQUIRE_HELLO": &cfg.Server.RequireHello,
+		"REQUIRE_READY": &cfg.Game.RequireReady,
+	}
+	for name, target := range bools {
+		if value, ok := os.LookupEnv(name); ok {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			*target = parsed
+		}
+	}
+	if value, ok := os.LookupEnv("ALLOWED_ORIGINS"); ok {
+		cfg.Server.AllowedOrigins = nil
+		for _, origin := range strings.Split(value, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				cfg.Server.AllowedOrigins = append(cfg.Server.AllowedOrigins, origin)
+			}
+		}
+	}
+
+	// SPAWN_POINTS is a list of x:y pairs such as "500:500,2060:940"
+	if value, ok := os.LookupEnv("SPAWN_POINTS"); ok {
+		cfg.Game.SpawnPoints = nil
+		for _, pair := range strings.Split(value, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			x, y, found := strings.Cut(pair, ":")
+			parsedX, errX := strconv.ParseFloat(x, 64)
+			parsedY, errY := strconv.ParseFloat(y, 64)
+			if !found || errX != nil || errY != nil {
+				return fmt.Errorf("SPAWN_POINTS: invalid point %q", pair)
+			}
+			cfg.Game.SpawnPoints = append(cfg.Game.SpawnPoints, SpawnPoint{X: parsedX, Y: parsedY})
+		}
+	}
+
+	ints := map[string]*int{
+		"RATE_BURST":     &cfg.Server.RateBurst,
+		"QUEUE_SIZE":     &cfg.Connection.QueueSize,
+		"STEPS_PER_TICK": &cfg.Game.StepsPerTick,
+		"MAX_PLAYERS":    &cfg.Game.MaxPlayers,
+		"MIN_PLAYERS":    &cfg.Game.MinPlayers,
+		"SCORE_LIMIT":    &cfg.Game.ScoreLimit,
+	}
+	for name, target := range ints {
+		if value, ok := os.LookupEnv(name); ok {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			*target = parsed
+		}
+	}
+
+	floats := map[string]*float64{
+		"RATE_LIMIT":        &cfg.Server.RateLimit,
+		"WORLD_WIDTH":       &cfg.Game.WorldWidth,
+		"WORLD_HEIGHT":      &cfg.Game.WorldHeight,
+		"ACCELERATION":      &cfg.Game.Acceleration,
+		"SMOOTHING":         &cfg.Game.Smoothing,
+		"DAMAGE":            &cfg.Game.Damage,
+		"MAX_HEALTH":        &cfg.Game.MaxHealth,
+		"PROJECTILE_SPEED":  &cfg.Game.ProjectileSpeed,
+		"PLAYER_RADIUS":     &cfg.Game.PlayerRadius,
+		"PROJECTILE_RADIUS": &cfg.Game.ProjectileRadius,
+	}
+	for name, target := range floats {
+		if value, ok := os.LookupEnv(name); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			*target = parsed
+		}
+	}
+
+	durations := map[string]*Duration{
+		"MAX_LAG":                &cfg.Connection.MaxLag,
+		"WRITE_WAIT":             &cfg.Connection.WriteWait,
+		"PING_PERIOD":            &cfg.Connection.PingPeriod,
+		"PONG_WAIT":              &cfg.Connection.PongWait,
+		"TICK_INTERVAL":          &cfg.Game.TickInterval,
+		"MAX_REWIND":             &cfg.Game.MaxRewind,
+		"KEYFRAME_INTERVAL":      &cfg.Game.KeyframeInterval,
+		"RECONNECT_GRACE_PERIOD": &cfg.Game.ReconnectGracePeriod,
+		"LOBBY_IDLE_TIMEOUT":     &cfg.Game.LobbyIdleTimeout,
+		"COUNTDOWN_DURATION":     &cfg.Game.CountdownDuration,
+		"TIME_LIMIT":             &cfg.Game.TimeLimit,
+		"RESULTS_DURATION":       &cfg.Game.ResultsDuration,
+		"ASSIST_WINDOW":          &cfg.Game.AssistWindow,
+		"RESPAWN_DELAY":          &cfg.Game.RespawnDelay,
+		"SPAWN_PROTECTION":       &cfg.Game.SpawnProtection,
+	}
+	for name, target := range durations {
+		if value, ok := os.LookupEnv(name); ok {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			target.Duration = parsed
+		}
+	}
+
+	return nil
+}
+
+func (cfg Config) Validate() error {
+	if cfg.Server.Address == "" {
+		return fmt.Errorf("server address must be set")
+	}
+	if cfg.Server.RateLimit <= 0 || cfg.Server.RateBurst < 1 {
+		return fmt.Errorf("rate limit and burst must be positive")
+	}
+	if cfg.Connection.QueueSize < 1 {
+		return fmt.Errorf("queue size must be positive")
+	}
+	if cfg.Connection.PingPeriod.Duration <= 0 || cfg.Connection.PongWait.Duration <= cfg.Connection.PingPeriod.Duration {
+		return fmt.Errorf("pong wait must be greater than a positive ping period")
+	}
+	if cfg.Connection.MaxLag.Duration <= 0 || cfg.Connection.WriteWait.Duration <= 0 {
+		return fmt.Errorf("max lag and write wait must be positive")
+	}
+	return cfg.Game.Validate()
+}
+
+func (game GameConfig) Validate() error {
+	if game.TickInterval.Duration <= 0 || game.StepsPerTick < 1 {
+		return fmt.Errorf("tick interval and steps per tick must be positive")
+	}
+	if game.WorldWidth <= 0 || game.WorldHeight <= 0 {
+		return fmt.Errorf("world dimensions must be positive")
+	}
+	if game.WorldWidth > protocol.MaxPosition || game.WorldHeight > protocol.MaxPosition {
+		return fmt.Errorf("world dimensions must be at most %d to fit the binary protocol", protocol.MaxPosition)
+	}
+	if len(game.SpawnPoints) == 0 {
+		return fmt.Errorf("at least one spawn point is needed")
+	}
+	for _, point := range game.SpawnPoints {
+		if point.X < 0 || point.X > game.WorldWidth || point.Y < 0 || point.Y > game.WorldHeight {
+			return fmt.Errorf("spawn point %v,%v must be inside the world", point.X, point.Y)
+		}
+	}
+	if game.MaxHealth <= 0 || game.Damage < 0 || game.ProjectileSpeed <= 0 {
+		return fmt.Errorf("health and projectile speed must be positive and damage not negative")
+	}
+	if game.PlayerRadius <= 0 || game.ProjectileRadius <= 0 {
+		return fmt.Errorf("collision radii must be positive")
+	}
+	if game.Acceleration < 0 || game.Smoothing <= 0 {
+		return fmt.Errorf("acceleration must not be negative and smoothing must be positive")
+	}
+	if game.MaxRewind.Duration < 0 {
+		return fmt.Errorf("max rewind must not be negative")
+	}
+	if game.KeyframeInterval.Duration <= 0 {
+		return fmt.Errorf("keyframe interval must be positive")
+	}
+	if game.MaxPlayers < 1 {
+		return fmt.Errorf("max players must be positive")
+	}
+	if game.MinPlayers < 1 {
+		return fmt.Errorf("min players must be positive")
+	}
+	if game.CountdownDuration.Duration < 0 || game.TimeLimit.Duration < 0 || game.ResultsDuration.Duration < 0 || game.ScoreLimit < 0 {
+		return fmt.Errorf("match durations and score limit must not be negative")
+	}
+	if game.AssistWindow.Duration < 0 {
+		return fmt.Errorf("assist window must not be negative")
+	}
+	if game.RespawnDelay.Duration < 0 || game.SpawnProtection.Duration < 0 {
+		return fmt.Errorf("respawn delay and spawn protection must not be negative")
+	}
+	if len(game.Weapons) == 0 {
+		return fmt.Errorf("at least one weapon is needed")
+	}
+	names := make(map[string]bool, len(game.Weapons))
+	for _, weapon := range game.Weapons {
+		if weapon.Name == "" || names[weapon.Name] {
+			return fmt.Errorf("weapon names must be set and unique")
+		}
+		names[weapon.Name] = true
+		if weapon.FireRate <= 0 || weapon.MagazineSize < 1 {
+			return fmt.Errorf("weapon %s must have a positive fire rate and magazine size", weapon.Name)
+		}
+		if weapon.ProjectileSpeed < 0 || weapon.Damage < 0 || weapon.Spread < 0 || weapon.ReloadTime.Duration < 0 {
+			return fmt.Errorf("weapon %s must not have negative stats", weapon.Name)
+		}
+	}
+	if game.ReconnectGracePeriod.Duration < 0 || game.LobbyIdleTimeout.Duration <= 0 {
+		return fmt.Errorf("reconnect grace period must not be negative and lobby idle timeout must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+package connection
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"myapp/src/authentication"
+	"myapp/src/config"
+	"myapp/src/protocol"
+	"myapp/src/types"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// rttSmoothing is the weight given to each new round-trip sample.
+const rttSmoothing = 0.125
+
+var (
+	ErrClosed           = errors.New("connection closed")
+	ErrNotAuthenticated = types.NewError(types.NotAuthenticated, "connection not authenticated")
+	ErrIdentityMismatch = types.NewError(types.IdentityMismatch, "token does not match connection")
+)
+
+// Identity is the player a connection is bound to after join_game,
+// resume_session or authenticate.
+type Identity struct {
+	PlayerID string
+	GameID   string
+	Username string
+	Token    string
+	// Another token accepted for the player, such as the one it authenticated
+	// or resumed with
+	AcceptedToken string
+}
+
+// Handshake is what a client declared about itself in hello. Features only
+// holds those the server supports as well.
+type Handshake struct {
+	Version  int
+	Features []string
+}
+
+// SafeConnection wraps a websocket so that every write goes through a single
+// writer goroutine fed by a bounded queue.
+//
+// QueueSize bounds the queue; a client whose queue fills up, or that keeps
+// falling behind on game updates for longer than MaxLag, is disconnected.
+// The peer is pinged every PingPeriod and dropped after PongWait of silence.
+type SafeConnection struct {
+	Conn     *websocket.Conn
+	settings config.ConnectionConfig
+
+	identityMutex sync.RWMutex
+	identity      *Identity
+	handshake     *Handshake
+
+	send chan []byte
+
+	// Game updates are coalesced: only the newest unsent one is kept.
+	stateMutex  sync.Mutex
+	latestState []byte
+	stateType   int
+	behindSince time.Time
+	stateReady  chan struct{}
+
+	// Smoothed round-trip time in nanoseconds
+	rtt atomic.Int64
+
+	closeOnce    sync.Once
+	closeMessage []byte
+	closing      chan struct{}
+	done         chan struct{}
+}
+
+func New(ws *websocket.Conn, settings config.ConnectionConfig) *SafeConnection {
+	c := &SafeConnection{
+		Conn:       ws,
+		settings:   settings,
+		send:       make(chan []byte, settings.QueueSize),
+		stateReady: make(chan struct{}, 1),
+		closing:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	ws.SetReadDeadline(time.Now().Add(settings.PongWait.Duration))
+	ws.SetPongHandler(c.handlePong)
+	go c.writePump()
+	return c
+}
+
+// Binary reports whether the client negotiated the binary subprotocol and did
+// not leave binary out of its hello.
+func (c *SafeConnection) Binary() bool {
+	return c.Conn.Subprotocol() == protocol.Binary && c.Supports(protocol.FeatureBinary)
+}
+
+// RTT returns the smoothed round-trip time measured with ping/pong frames.
+func (c *SafeConnection) RTT() time.Duration {
+	return time.Duration(c.rtt.Load())
+}
+
+func (c *SafeConnection) handlePong(appData string) error {
+	// The ping payload carries the time it was sent
+	sentAt, err := strconv.ParseInt(appData, 10, 64)
+	if err == nil {
+		sample := time.Since(time.Unix(0, sentAt))
+		previous := c.RTT()
+		if previous == 0 {
+			c.rtt.Store(int64(sample))
+		} else {
+			c.rtt.Store(int64(float64(previous) + rttSmoothing*float64(sample-previous)))
+		}
+	}
+	return c.Conn.SetReadDeadline(time.Now().Add(c.settings.PongWait.Duration))
+}
+
+// Bind ties the connection to a player. Messages on this connection act as
+// that player from now on.
+func (c *SafeConnection) Bind(identity Identity) {
+	c.identityMutex.Lock()
+	defer c.identityMutex.Unlock()
+	c.identity = &identity
+}
+
+func (c *SafeConnection) Unbind() {
+	c.identityMutex.Lock()
+	defer c.identityMutex.Unlock()
+	c.identity = nil
+}
+
+// Identity returns the player the connection is bound to, if any.
+func (c *SafeConnection) Identity() (Identity, bool) {
+	c.identityMutex.RLock()
+	defer c.identityMutex.RUnlock()
+	if c.identity == nil {
+		return Identity{}, false
+	}
+	return *c.identity, true
+}
+
+// SetHandshake records the client's hello.
+func (c *SafeConnection) SetHandshake(handshake Handshake) {
+	c.identityMutex.Lock()
+	defer c.identityMutex.Unlock()
+	c.handshake = &handshake
+}
+
+// Handshake returns the client's hello, if it has sent one.
+func (c *SafeConnection) Handshake() (Handshake, bool) {
+	c.identityMutex.RLock()
+	defer c.identityMutex.RUnlock()
+	if c.handshake == nil {
+		return Handshake{}, false
+	}
+	return *c.handshake, true
+}
+
+// Supports reports whether the client and server agreed on a feature. A client
+// that never sent hello is assumed to support everything.
+func (c *SafeConnection) Supports(feature string) bool {
+	handshake, ok := c.Handshake()
+	if !ok {
+		return true
+	}
+	for _, supported := range handshake.Features {
+		if supported == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize returns the bound identity, rejecting a message whose token does
+// not belong to it. Messages that carry no token use the bound identity.
+//
+// A token other than the one the connection was bound with is accepted if it
+// names the same player, since clients may still be sending the token they
+// authenticated or resumed with when the new one is issued.
+func (c *SafeConnection) Authorize(token string) (Identity, error) {
+	identity, ok := c.Identity()
+	if !ok {
+		return Identity{}, ErrNotAuthenticated
+	}
+	if token == "" || token == identity.Token || token == identity.AcceptedToken {
+		return identity, nil
+	}
+	parsed, claims, err := authentication.ParseToken(token)
+	if err != nil || !parsed.Valid || claims.PlayerID != identity.PlayerID || claims.GameId != identity.GameID {
+		return Identity{}, ErrIdentityMismatch
+	}
+
+	// Remember it, so that a client sticking to this token is only verified once
+	c.identityMutex.Lock()
+	if c.identity != nil && c.identity.PlayerID == identity.PlayerID {
+		c.identity.AcceptedToken = token
+	}
+	c.identityMutex.Unlock()
+	return identity, nil
+}
+
+// Send queues a message for the writer. A client whose queue is full is
+// disconnected rather than allowed to block the caller.
+func (c *SafeConnection) Send(message []byte) error {
+	select {
+	case <-c.closing:
+		return ErrClosed
+	default:
+	}
+
+	select {
+	case c.send <- message:
+		return nil
+	default:
+		c.Close(websocket.CloseTryAgainLater, "client too slow")
+		return ErrClosed
+	}
+}
+
+func (c *SafeConnection) SendJSON(response types.FrontendResponse) error {
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	return c.Send(jsonResponse)
+}
+
+// SendState queues a game update, replacing any update the writer has not
+// sent yet. messageType is websocket.TextMessage or websocket.BinaryMessage.
+func (c *SafeConnection) SendState(messageType int, message []byte) {
+	c.stateMutex.Lock()
+	if c.latestState != nil && c.behindSince.IsZero() {
+		c.behindSince = time.Now()
+	}
+	lagging := !c.behindSince.IsZero() && time.Since(c.behindSince) > c.settings.MaxLag.Duration
+	c.latestState = message
+	c.stateType = messageType
+	c.stateMutex.Unlock()
+
+	if lagging {
+		c.Close(websocket.CloseTryAgainLater, "client too slow")
+		return
+	}
+
+	select {
+	case c.stateReady <- struct{}{}:
+	default:
+	}
+}
+
+func (c *SafeConnection) takeState() (int, []byte) {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	message := c.latestState
+	c.latestState = nil
+	c.behindSince = time.Time{}
+	return c.stateType, message
+}
+
+// Close asks the writer to send a close frame with the given reason and shut
+// the socket down. Only the first call has any effect.
+func (c *SafeConnection) Close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeMessage = websocket.FormatCloseMessage(code, reason)
+		close(c.closing)
+	})
+}
+
+// Done is closed once the writer has stopped.
+func (c *SafeConnection) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *SafeConnection) write(messageType int, message []byte) error {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.settings.WriteWait.Duration))
+	return c.Conn.WriteMessage(messageType, message)
+}
+
+func (c *SafeConnection) writePump() {
+	ticker := time.NewTicker(c.settings.PingPeriod.Duration)
+	defer func() {
+		ticker.Stop()
+		c.Close(websocket.CloseNormalClosure, "")
+		c.Conn.Close()
+		close(c.done)
+	}()
+
+	for {
+		select {
+		case <-c.closing:
+			// Send what was queued before the close, such as the error that
+			// caused it
+			if !c.flushQueue() {
+				return
+			}
+			if err := c.write(websocket.CloseMessage, c.closeMessage); err != nil {
+				log.Println("Error sending close message:", err)
+			}
+			return
+		case <-ticker.C:
+			ping := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+			if err := c.Conn.WriteControl(websocket.PingMessage, ping, time.Now().Add(c.settings.WriteWait.Duration)); err != nil {
+				log.Println("Error sending ping:", err)
+				return
+			}
+		case message := <-c.send:
+			if err := c.write(websocket.TextMessage, message); err != nil {
+				log.Println("Error writing to WebSocket:", err)
+				return
+			}
+		case <-c.stateReady:
+			// Flush queued events first so they are not overtaken by newer state
+			if !c.flushQueue() {
+				return
+			}
+			if messageType, message := c.takeState(); message != nil {
+				if err := c.write(messageType, message); err != nil {
+					log.Println("Error writing to WebSocket:", err)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *SafeConnection) flushQueue() bool {
+	for {
+		select {
+		case message := <-c.send:
+			if err := c.write(websocket.TextMessage, message); err != nil {
+				log.Println("Error writing to WebSocket:", err)
+				return false
+			}
+		default:
+			return true
+		}
+	}
+}
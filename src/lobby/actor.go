@@ -0,0 +1,173 @@
+package lobby
+
+import (
+	"fmt"
+	"myapp/src/clock"
+	"myapp/src/config"
+	"myapp/src/types"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// globalGameState only indexes lobbies. Each lobby's state is owned by its own
+// goroutine and is changed by sending it commands.
+var globalGameState = struct {
+	sync.RWMutex
+	Lobbies map[string]*GameState
+}{
+	Lobbies: make(map[string]*GameState),
+}
+
+// maxCatchUpTicks bounds how many ticks worth of steps a lobby runs at once
+// after falling behind.
+const maxCatchUpTicks = 5
+
+// command is run by a lobby's goroutine with exclusive access to its state.
+type command func(lobby *GameState)
+
+// gameClock drives the lobbies created from now on.
+var gameClock clock.Clock = clock.Real{}
+
+func newGameState(cfg config.GameConfig, clk clock.Clock) *GameState {
+	lobby := &GameState{
+		GameID:      uuid.New().String(),
+		Settings:    defaultSettings(cfg),
+		Phase:       PhaseWaiting,
+		Players:     []Player{},
+		Projectiles: []Projectile{},
+		config:      cfg,
+		defaults:    cfg,
+		clock:       clk,
+		commands:    make(chan command, 256),
+		done:        make(chan struct{}),
+	}
+	lobby.spread = newSpreadSource(lobby.GameID)
+	lobby.history = newPositionHistory(lobby.historySize())
+	lobby.snapshots = newSnapshotHistory(snapshotHistorySize)
+	return lobby
+}
+
+// registerLobby makes a lobby reachable by id and join code and starts its
+// goroutine.
+func registerLobby(lobby *GameState) {
+	globalGameState.Lock()
+	globalGameState.Lobbies[lobby.GameID] = lobby
+	assignJoinCode(lobby)
+	globalGameState.Unlock()
+	if lobby.Settings.Name == "" {
+		lobby.Settings.Name = "Lobby " + lobby.JoinCode
+	}
+	lobby.publishSummary()
+	go lobby.run()
+}
+
+// unregisterLobby makes a lobby that has stopped unreachable and releases its
+// join code.
+func unregisterLobby(lobby *GameState) {
+	globalGameState.Lock()
+	delete(globalGameState.Lobbies, lobby.GameID)
+	delete(joinCodes, lobby.JoinCode)
+	globalGameState.Unlock()
+	withdrawSummary(lobby.GameID)
+	removeLobbyMembers(lobby.GameID)
+}
+
+func findLobby(gameID string) (*GameState, bool) {
+	globalGameState.RLock()
+	defer globalGameState.RUnlock()
+	lobby, ok := globalGameState.Lobbies[gameID]
+	return lobby, ok
+}
+
+func (lobby *GameState) run() {
+	defer close(lobby.done)
+
+	ticker := lobby.clock.NewTicker(lobby.config.TickInterval.Duration)
+	defer ticker.Stop()
+	lobby.lastTick = lobby.clock.Now()
+
+	for {
+		select {
+		case cmd := <-lobby.commands:
+			cmd(lobby)
+			if lobby.closed {
+				return
+			}
+		case now := <-ticker.C():
+			lobby.advance(now)
+			if lobby.closed {
+				return
+			}
+		}
+	}
+}
+
+// advance runs as many fixed steps as fit into the time since the last call,
+// then broadcasts the result. The leftover time carries over to the next call.
+func (lobby *GameState) advance(now time.Time) {
+	stepInterval := lobby.stepInterval()
+	lobby.accumulator += now.Sub(lobby.lastTick)
+	lobby.lastTick = now
+
+	steps := 0
+	maxSteps := maxCatchUpTicks * lobby.config.StepsPerTick
+	for lobby.accumulator >= stepInterval && steps < maxSteps && !lobby.closed {
+		lobby.step()
+		lobby.accumulator -= stepInterval
+		steps++
+	}
+	if steps == maxSteps {
+		// Too far behind to catch up, drop the backlog rather than spiral
+		lobby.accumulator = 0
+	}
+
+	if steps > 0 && !lobby.closed {
+		broadcastGameState(lobby)
+		broadcastScoreboard(lobby)
+	}
+}
+
+func (lobby *GameState) stepInterval() time.Duration {
+	return lobby.config.TickInterval.Duration / time.Duration(lobby.config.StepsPerTick)
+}
+
+// do queues a command without waiting for it to run. It reports false if the
+// lobby has already closed.
+func (lobby *GameState) do(cmd command) bool {
+	select {
+	case lobby.commands <- cmd:
+		return true
+	case <-lobby.done:
+		return false
+	}
+}
+
+// call runs a command and waits for its result.
+func (lobby *GameState) call(cmd func(lobby *GameState) error) error {
+	result := make(chan error, 1)
+	if !lobby.do(func(lobby *GameState) { result <- cmd(lobby) }) {
+		return types.NewError(types.LobbyNotFound, "lobby %s not found", lobby.GameID)
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-lobby.done:
+		return types.NewError(types.LobbyNotFound, "lobby %s not found", lobby.GameID)
+	}
+}
+
+// closeIfIdle shuts down a lobby that has had no players for the idle
+// timeout. It runs every step.
+func (lobby *GameState) closeIfIdle() {
+	if lobby.closed || len(lobby.Players) > 0 ||
+		lobby.Tick-lobby.LastActivity <= lobby.ticksFor(lobby.config.LobbyIdleTimeout.Duration) {
+		return
+	}
+
+	// Lobby is inactive and has no players, remove it
+	lobby.closed = true
+	unregisterLobby(lobby)
+	fmt.Printf("Lobby %s removed due to inactivity\n", lobby.GameID)
+}
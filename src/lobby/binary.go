@@ -0,0 +1,145 @@
+package lobby
+
+import (
+	"myapp/src/protocol"
+	"reflect"
+	"strconv"
+)
+
+// Button bits of a binary player input.
+const (
+	inputUp = 1 << iota
+	inputDown
+	inputLeft
+	inputRight
+)
+
+// DecodePlayerInput reads a binary player_update_position: sequence (uint32),
+// buttons (uint8), mouse x and y (positions) and ackTick (uvarint).
+func DecodePlayerInput(r *protocol.Reader) PlayerInput {
+	input := PlayerInput{Sequence: r.Uint32()}
+	buttons := r.Uint8()
+	input.Up = buttons&inputUp != 0
+	input.Down = buttons&inputDown != 0
+	input.Left = buttons&inputLeft != 0
+	input.Right = buttons&inputRight != 0
+	input.MousePositionX = r.Position()
+	input.MousePositionY = r.Position()
+	input.AckTick = r.Uvarint()
+	return input
+}
+
+// DecodeShootRequest reads a binary player_shoot_projectile: viewTick (uvarint).
+func DecodeShootRequest(r *protocol.Reader) ShootRequest {
+	return ShootRequest{ViewTick: r.Uvarint()}
+}
+
+// DecodeSnapshotAck reads a binary snapshot_ack: tick (uvarint).
+func DecodeSnapshotAck(r *protocol.Reader) SnapshotAckRequest {
+	return SnapshotAckRequest{Tick: r.Uvarint()}
+}
+
+// DecodeEmpty reads a binary message that has no payload.
+func DecodeEmpty(r *protocol.Reader) struct{} {
+	return struct{}{}
+}
+
+// fieldEncoder writes one field of a state struct.
+type fieldEncoder func(w *protocol.Writer, value interface{})
+
+// playerFieldEncoders follows the field order of PlayerState.
+var playerFieldEncoders = []fieldEncoder{
+	func(w *protocol.Writer, v interface{}) { w.UUID(v.(string)) },
+	func(w *protocol.Writer, v interface{}) { w.String(v.(string)) },
+	func(w *protocol.Writer, v interface{}) { w.Health(v.(float64)) },
+	func(w *protocol.Writer, v interface{}) { w.Position(v.(float64)) },
+	func(w *protocol.Writer, v interface{}) { w.Position(v.(float64)) },
+	func(w *protocol.Writer, v interface{}) { w.Velocity(v.(float64)) },
+	func(w *protocol.Writer, v interface{}) { w.Velocity(v.(float64)) },
+	func(w *protocol.Writer, v interface{}) { w.Angle(v.(float64)) },
+	func(w *protocol.Writer, v interface{}) { w.Uint16(uint16(clamp(v.(float64), 0, 65535))) },
+	func(w *protocol.Writer, v interface{}) { w.Bool(v.(bool)) },
+	func(w *protocol.Writer, v interface{}) { w.Uint32(v.(uint32)) },
+	func(w *protocol.Writer, v interface{}) { w.Bool(v.(bool)) },
+	func(w *protocol.Writer, v interface{}) { w.Uvarint(uint64(v.(int))) },
+	func(w *protocol.Writer, v interface{}) { w.Uint8(uint8(v.(int))) },
+	func(w *protocol.Writer, v interface{}) { w.Bool(v.(bool)) },
+	func(w *protocol.Writer, v interface{}) { w.Uvarint(v.(uint64)) },
+	func(w *protocol.Writer, v interface{}) { w.Uvarint(v.(uint64)) },
+	func(w *protocol.Writer, v interface{}) { w.String(v.(string)) },
+	func(w *protocol.Writer, v interface{}) { w.Uvarint(uint64(v.(int))) },
+	func(w *protocol.Writer, v interface{}) { w.Uvarint(v.(uint64)) },
+}
+
+// projectileFieldEncoders follows the field order of ProjectileState.
+var projectileFieldEncoders = []fieldEncoder{
+	encodeSerial,
+	func(w *protocol.Writer, v interface{}) { w.UUID(v.(string)) },
+	func(w *protocol.Writer, v interface{}) { w.Position(v.(float64)) },
+	func(w *protocol.Writer, v interface{}) { w.Position(v.(float64)) },
+	func(w *protocol.Writer, v interface{}) { w.Velocity(v.(float64)) },
+	func(w *protocol.Writer, v interface{}) { w.Velocity(v.(float64)) },
+}
+
+// encodeSerial writes a projectile id, which is a per-lobby counter.
+func encodeSerial(w *protocol.Writer, v interface{}) {
+	serial, _ := strconv.ParseUint(v.(string), 10, 64)
+	w.Uvarint(serial)
+}
+
+func encodeState(w *protocol.Writer, encoders []fieldEncoder, state interface{}) {
+	value := reflect.ValueOf(state)
+	for i, encode := range encoders {
+		encode(w, value.Field(i).Interface())
+	}
+}
+
+func encodeChanges(w *protocol.Writer, encoders []fieldEncoder, changes FieldChanges) {
+	encoders[0](w, changes.ID)
+	w.Uvarint(changes.Mask)
+	value := 0
+	for i := 1; i < len(encoders); i++ {
+		if changes.Mask&(1<<uint(i)) != 0 {
+			encoders[i](w, changes.Values[value])
+			value++
+		}
+	}
+}
+
+// encodeBinary writes a game_update as: tick and baseline (uvarints), a
+// keyframe flag, then for players and for projectiles the spawned entities in
+// full, the changed ones as id, field mask and changed fields, and the ids of
+// despawned ones, each list preceded by its length.
+func (update SnapshotUpdate) encodeBinary() []byte {
+	w := protocol.NewWriter(protocol.OpGameUpdate)
+	w.Uvarint(update.Tick)
+	w.Uvarint(update.Baseline)
+	w.Bool(update.Keyframe)
+
+	w.Uvarint(uint64(len(update.Players.Spawned)))
+	for _, state := range update.Players.Spawned {
+		encodeState(w, playerFieldEncoders, state)
+	}
+	w.Uvarint(uint64(len(update.Players.Changed)))
+	for _, changes := range update.Players.Changed {
+		encodeChanges(w, playerFieldEncoders, changes)
+	}
+	w.Uvarint(uint64(len(update.Players.Despawned)))
+	for _, id := range update.Players.Despawned {
+		playerFieldEncoders[0](w, id)
+	}
+
+	w.Uvarint(uint64(len(update.Projectiles.Spawned)))
+	for _, state := range update.Projectiles.Spawned {
+		encodeState(w, projectileFieldEncoders, state)
+	}
+	w.Uvarint(uint64(len(update.Projectiles.Changed)))
+	for _, changes := range update.Projectiles.Changed {
+		encodeChanges(w, projectileFieldEncoders, changes)
+	}
+	w.Uvarint(uint64(len(update.Projectiles.Despawned)))
+	for _, id := range update.Projectiles.Despawned {
+		encodeSerial(w, id)
+	}
+	return w.Bytes()
+}
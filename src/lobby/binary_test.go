@@ -0,0 +1,118 @@
+package lobby
+
+import (
+	"bytes"
+	"encoding/binary"
+	"myapp/src/protocol"
+	"reflect"
+	"testing"
+)
+
+type stateEncoding struct {
+	name     string
+	state    interface{}
+	encoders []fieldEncoder
+	fields   stateFields
+}
+
+func stateEncodings() []stateEncoding {
+	player := PlayerState{
+		PlayerID: "00000000-0000-4000-8000-000000000001", Username: "bob", Health: 100,
+		PositionX: 500, PositionY: 400, VelocityX: 1.5, VelocityY: -2, Angle: 1, Ping: 30,
+		Connected: true, LastProcessedInput: 7, Score: 2, Team: 1, RespawnTick: 40,
+		ProtectedUntil: 50, Weapon: "blaster", Ammo: 12, ReloadTick: 60,
+	}
+	projectile := ProjectileState{
+		ProjectileID: "42", PlayerID: player.PlayerID,
+		PositionX: 100, PositionY: 200, VelocityX: 13, VelocityY: -13,
+	}
+	return []stateEncoding{
+		{"player", player, playerFieldEncoders, playerStateFields},
+		{"projectile", projectile, projectileFieldEncoders, projectileStateFields},
+	}
+}
+
+// changed returns a copy of state with field i set to a different value.
+func changed(state interface{}, i int) interface{} {
+	value := reflect.New(reflect.TypeOf(state)).Elem()
+	value.Set(reflect.ValueOf(state))
+	field := value.Field(i)
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(field.String() + "x")
+	case reflect.Float64:
+		field.SetFloat(field.Float() + 1.5)
+	case reflect.Bool:
+		field.SetBool(!field.Bool())
+	case reflect.Int:
+		field.SetInt(field.Int() + 1)
+	case reflect.Uint32, reflect.Uint64:
+		field.SetUint(field.Uint() + 1)
+	default:
+		panic("no way to change a " + field.Kind().String())
+	}
+	return value.Interface()
+}
+
+// TestFieldEncodersMatchState catches a field added to a state struct without
+// an encoder, which would set its mask bit but never write its value.
+func TestFieldEncodersMatchState(t *testing.T) {
+	for _, tt := range stateEncodings() {
+		if fields := reflect.TypeOf(tt.state).NumField(); len(tt.encoders) != fields {
+			t.Errorf("%s has %d fields but %d encoders", tt.name, fields, len(tt.encoders))
+		}
+	}
+}
+
+// TestEncodeChangesRoundTrip reads back the mask and values of a delta for
+// each field changing alone and for all of them changing at once.
+func TestEncodeChangesRoundTrip(t *testing.T) {
+	for _, tt := range stateEncodings() {
+		numFields := reflect.TypeOf(tt.state).NumField()
+		all := tt.state
+		for i := 1; i < numFields; i++ {
+			all = changed(all, i)
+		}
+
+		cases := map[string]interface{}{"all fields": all}
+		for i := 1; i < numFields; i++ {
+			cases[tt.fields[i]] = changed(tt.state, i)
+		}
+		for name, current := range cases {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				changes := tt.fields.diff(tt.state, current)
+				w := protocol.NewWriter(0)
+				encodeChanges(w, tt.encoders, changes)
+
+				// The id comes first, then the mask
+				id := protocol.NewWriter(0)
+				tt.encoders[0](id, changes.ID)
+				got := w.Bytes()
+				if !bytes.HasPrefix(got, id.Bytes()) {
+					t.Fatalf("delta does not start with the id")
+				}
+				r := protocol.NewReader(got[len(id.Bytes()):])
+				if mask := r.Uvarint(); mask != changes.Mask || r.Err() != nil {
+					t.Fatalf("mask = %b, want %b (%v)", mask, changes.Mask, r.Err())
+				}
+
+				// Then exactly the changed fields, in order, each written as
+				// it is in a full state
+				want := protocol.NewWriter(0)
+				value := reflect.ValueOf(current)
+				for i := 1; i < numFields; i++ {
+					if changes.Mask&(1<<uint(i)) != 0 {
+						tt.encoders[i](want, value.Field(i).Interface())
+					}
+				}
+				values := got[len(id.Bytes())+len(binary.AppendUvarint(nil, changes.Mask)):]
+				if !bytes.Equal(values, want.Bytes()[1:]) {
+					t.Errorf("values = % x, want % x", values, want.Bytes()[1:])
+				}
+				if name == "all fields" && len(changes.Values) != numFields-1 {
+					t.Errorf("%d changed values, want %d", len(changes.Values), numFields-1)
+				}
+			})
+		}
+	}
+}
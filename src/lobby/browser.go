@@ -0,0 +1,248 @@
+package lobby
+
+import (
+	"myapp/src/connection"
+	"myapp/src/router"
+	"myapp/src/types"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	LOBBY_OPENED_EVENT  = "lobby_opened"
+	LOBBY_UPDATED_EVENT = "lobby_updated"
+	LOBBY_CLOSED_EVENT  = "lobby_closed"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// LobbySummary is what the lobby browser shows about a lobby.
+type LobbySummary struct {
+	LobbyID  string `json:"lobbyId"`
+	JoinCode string `json:"joinCode"`
+	Name     string `json:"name"`
+	Players  int    `json:"players"`
+	Capacity int    `json:"capacity"`
+	Mode     string `json:"mode"`
+	State    string `json:"state"` // Match phase
+
+	public bool
+}
+
+// LobbyFilter narrows the lobbies listed. Empty fields match everything.
+type LobbyFilter struct {
+	Mode    string `json:"mode" query:"mode"`
+	State   string `json:"state" query:"state"`
+	NotFull bool   `json:"notFull" query:"notFull"`
+	// Case-insensitive substring of the lobby name
+	Search string `json:"search" query:"search"`
+}
+
+// matches reports whether a lobby should be shown to a client using the
+// filter. Private lobbies are never listed.
+func (filter LobbyFilter) matches(summary LobbySummary) bool {
+	if !summary.public {
+		return false
+	}
+	if filter.Mode != "" && filter.Mode != summary.Mode {
+		return false
+	}
+	if filter.State != "" && filter.State != summary.State {
+		return false
+	}
+	if filter.NotFull && summary.Players >= summary.Capacity {
+		return false
+	}
+	if filter.Search != "" && !strings.Contains(strings.ToLower(summary.Name), strings.ToLower(filter.Search)) {
+		return false
+	}
+	return true
+}
+
+type ListLobbiesRequest struct {
+	LobbyFilter
+	Offset int `json:"offset" query:"offset"`
+	Limit  int `json:"limit" query:"limit"`
+	// Keep sending lobby_opened, lobby_updated and lobby_closed for lobbies
+	// matching the filter
+	Subscribe bool `json:"subscribe" query:"-"`
+}
+
+type LobbyList struct {
+	Lobbies []LobbySummary `json:"lobbies"`
+	Total   int            `json:"total"`
+	Offset  int            `json:"offset"`
+	Limit   int            `json:"limit"`
+}
+
+// lobbyDirectory holds the latest summary of every lobby, published by the
+// lobbies themselves, so that listing never waits on a lobby's goroutine.
+var lobbyDirectory = struct {
+	sync.Mutex
+	summaries   map[string]LobbySummary
+	subscribers map[*connection.SafeConnection]LobbyFilter
+}{
+	summaries:   make(map[string]LobbySummary),
+	subscribers: make(map[*connection.SafeConnection]LobbyFilter),
+}
+
+func (lobby *GameState) summary() LobbySummary {
+	return LobbySummary{
+		LobbyID:  lobby.GameID,
+		JoinCode: lobby.JoinCode,
+		Name:     lobby.Settings.Name,
+		Players:  len(lobby.Players),
+		Capacity: lobby.Settings.MaxPlayers,
+		Mode:     lobby.Settings.Mode,
+		State:    lobby.Phase,
+		public:   lobby.Settings.Public,
+	}
+}
+
+// publishSummary updates the lobby's entry in the directory and tells
+// subscribers about the change. It is called by the lobby whenever something
+// shown in the browser may have changed.
+func (lobby *GameState) publishSummary() {
+	current := lobby.summary()
+
+	lobbyDirectory.Lock()
+	defer lobbyDirectory.Unlock()
+	previous, existed := lobbyDirectory.summaries[current.LobbyID]
+	if existed && previous == current {
+		return
+	}
+	lobbyDirectory.summaries[current.LobbyID] = current
+
+	for conn, filter := range lobbyDirectory.subscribers {
+		wasShown := existed && filter.matches(previous)
+		switch shown := filter.matches(current); {
+		case shown && wasShown:
+			notifySubscriber(conn, LOBBY_UPDATED_EVENT, current)
+		case shown:
+			notifySubscriber(conn, LOBBY_OPENED_EVENT, current)
+		case wasShown:
+			notifySubscriber(conn, LOBBY_CLOSED_EVENT, lobbyClosed(current.LobbyID))
+		}
+	}
+}
+
+// withdrawSummary removes a lobby that has closed from the directory.
+func withdrawSummary(gameID string) {
+	lobbyDirectory.Lock()
+	defer lobbyDirectory.Unlock()
+	previous, existed := lobbyDirectory.summaries[gameID]
+	if !existed {
+		return
+	}
+	delete(lobbyDirectory.summaries, gameID)
+
+	for conn, filter := range lobbyDirectory.subscribers {
+		if filter.matches(previous) {
+			notifySubscriber(conn, LOBBY_CLOSED_EVENT, lobbyClosed(gameID))
+		}
+	}
+}
+
+func lobbyClosed(gameID string) map[string]interface{} {
+	return map[string]interface{}{"lobbyId": gameID}
+}
+
+// notifySubscriber queues a push for a subscriber. lobbyDirectory must be
+// locked; Send never blocks.
+func notifySubscriber(conn *connection.SafeConnection, id string, data interface{}) {
+	conn.SendJSON(types.FrontendResponse{ID: id, Data: data})
+}
+
+// listLobbies returns one page of the public lobbies matching the filter,
+// ordered by name.
+func listLobbies(request ListLobbiesRequest) LobbyList {
+	lobbyDirectory.Lock()
+	matching := []LobbySummary{}
+	for _, summary := range lobbyDirectory.summaries {
+		if request.matches(summary) {
+			matching = append(matching, summary)
+		}
+	}
+	lobbyDirectory.Unlock()
+
+	sort.Slice(matching, func(i, j int) bool {
+		if matching[i].Name != matching[j].Name {
+			return matching[i].Name < matching[j].Name
+		}
+		return matching[i].LobbyID < matching[j].LobbyID
+	})
+
+	limit := request.Limit
+	if limit <= 0 {
+		limit = defaultPageSize
+	} else if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	offset := request.Offset
+	if offset < 0 {
+		offset = 0
+	}
+	page := []LobbySummary{}
+	if offset < len(matching) {
+		end := offset + limit
+		if end > len(matching) {
+			end = len(matching)
+		}
+		page = matching[offset:end]
+	}
+	return LobbyList{
+		Lobbies: page,
+		Total:   len(matching),
+		Offset:  offset,
+		Limit:   limit,
+	}
+}
+
+// ListLobbies replies with a page of public lobbies. With subscribe set the
+// connection is also sent live changes to lobbies matching the filter, until
+// unsubscribe_lobbies or a later list_lobbies without subscribe.
+func ListLobbies(ctx *router.Context, request ListLobbiesRequest) error {
+	lobbyDirectory.Lock()
+	if request.Subscribe {
+		lobbyDirectory.subscribers[ctx.Conn] = request.LobbyFilter
+	} else {
+		delete(lobbyDirectory.subscribers, ctx.Conn)
+	}
+	lobbyDirectory.Unlock()
+
+	return ctx.Reply(types.FrontendResponse{
+		ID:   "lobby_list",
+		Data: listLobbies(request),
+	})
+}
+
+func UnsubscribeLobbies(ctx *router.Context) error {
+	unsubscribeLobbies(ctx.Conn)
+	return ctx.Reply(types.FrontendResponse{
+		ID:   "lobbies_unsubscribed",
+		Data: nil,
+	})
+}
+
+func unsubscribeLobbies(conn *connection.SafeConnection) {
+	lobbyDirectory.Lock()
+	defer lobbyDirectory.Unlock()
+	delete(lobbyDirectory.subscribers, conn)
+}
+
+// ListLobbiesHTTP serves GET /api/lobbies with the same filters and paging
+// as list_lobbies, given as query parameters.
+func ListLobbiesHTTP(c echo.Context) error {
+	var request ListLobbiesRequest
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, &request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, listLobbies(request))
+}
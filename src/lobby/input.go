@@ -0,0 +1,69 @@
+package lobby
+
+import "sort"
+
+// maxPendingInputs bounds a player's input backlog. Beyond it the oldest
+// inputs are applied immediately instead of one per step.
+const maxPendingInputs = 8
+
+// PlayerInput is the state of a player's controls sent with
+// player_update_position. Sequence increases by at least one with every input
+// a client sends; zero marks an unsequenced input from an older client.
+// AckTick acknowledges the newest game_update the client has applied.
+type PlayerInput struct {
+	Sequence       uint32  `json:"sequence"`
+	Up             bool    `json:"up"`
+	Down           bool    `json:"down"`
+	Left           bool    `json:"left"`
+	Right          bool    `json:"right"`
+	MousePositionX float64 `json:"mousePositionX"`
+	MousePositionY float64 `json:"mousePositionY"`
+	AckTick        uint64  `json:"ackTick"`
+}
+
+// queueInput stores an input to be applied in sequence order, dropping it if
+// it is stale or a duplicate.
+func (player *Player) queueInput(input PlayerInput) {
+	if input.Sequence == 0 {
+		player.applyInput(input)
+		return
+	}
+	if input.Sequence <= player.LastProcessedInput {
+		return
+	}
+
+	i := sort.Search(len(player.pendingInputs), func(i int) bool {
+		return player.pendingInputs[i].Sequence >= input.Sequence
+	})
+	if i < len(player.pendingInputs) && player.pendingInputs[i].Sequence == input.Sequence {
+		return
+	}
+	player.pendingInputs = append(player.pendingInputs, PlayerInput{})
+	copy(player.pendingInputs[i+1:], player.pendingInputs[i:])
+	player.pendingInputs[i] = input
+}
+
+// consumeInput applies the oldest pending input, so that each input is
+// simulated for one step as it was on the client.
+func (player *Player) consumeInput() {
+	for len(player.pendingInputs) > maxPendingInputs {
+		player.applyInput(player.pendingInputs[0])
+		player.pendingInputs = player.pendingInputs[1:]
+	}
+	if len(player.pendingInputs) > 0 {
+		player.applyInput(player.pendingInputs[0])
+		player.pendingInputs = player.pendingInputs[1:]
+	}
+}
+
+func (player *Player) applyInput(input PlayerInput) {
+	player.Controls.Up = input.Up
+	player.Controls.Down = input.Down
+	player.Controls.Left = input.Left
+	player.Controls.Right = input.Right
+	player.MousePositionX = input.MousePositionX
+	player.MousePositionY = input.MousePositionY
+	if input.Sequence > player.LastProcessedInput {
+		player.LastProcessedInput = input.Sequence
+	}
+}
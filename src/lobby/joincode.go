@@ -0,0 +1,60 @@
+package lobby
+
+import (
+	"crypto/rand"
+	"strings"
+)
+
+// joinCodeAlphabet leaves out letters and digits that are easily confused,
+// such as O and 0 or I and 1. Its 32 characters map evenly onto random bytes.
+const joinCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const joinCodeLength = 6
+
+// joinCodes maps the join code of every registered lobby to its game id. It is
+// guarded by globalGameState.
+var joinCodes = make(map[string]string)
+
+func newJoinCode() string {
+	b := make([]byte, joinCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	for i := range b {
+		b[i] = joinCodeAlphabet[int(b[i])%len(joinCodeAlphabet)]
+	}
+	return string(b)
+}
+
+// assignJoinCode gives a lobby a code no other lobby holds.
+// globalGameState must be locked.
+func assignJoinCode(lobby *GameState) {
+	for {
+		code := newJoinCode()
+		if _, taken := joinCodes[code]; !taken {
+			joinCodes[code] = lobby.GameID
+			lobby.JoinCode = code
+			return
+		}
+	}
+}
+
+// normalizeJoinCode lets players type codes in lower case or with spaces.
+func normalizeJoinCode(code string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(code), ""))
+}
+
+// findLobbyByIDOrCode looks a lobby up by its game id or its join code.
+func findLobbyByIDOrCode(idOrCode string) (*GameState, bool) {
+	if lobby, ok := findLobby(idOrCode); ok {
+		return lobby, true
+	}
+	globalGameState.RLock()
+	defer globalGameState.RUnlock()
+	gameID, ok := joinCodes[normalizeJoinCode(idOrCode)]
+	if !ok {
+		return nil, false
+	}
+	lobby, ok := globalGameState.Lobbies[gameID]
+	return lobby, ok
+}
@@ -1,48 +1,70 @@
 package lobby
 
 import (
-	"encoding/json"
 	"fmt"
-	"log"
 	"math"
+	"math/rand"
 	"myapp/src/authentication"
+	"myapp/src/clock"
+	"myapp/src/config"
+	"myapp/src/connection"
+	"myapp/src/protocol"
+	"myapp/src/router"
 	"myapp/src/types"
-	"sync"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	"github.com/labstack/echo/v4"
 )
 
-type SafeConnection struct {
-	Conn  *websocket.Conn
-	Mutex sync.Mutex
-}
-
-var (
-	activeConnections = make(map[string]*SafeConnection)
-	connMutex         sync.Mutex
-)
+// gameConfig holds the settings new lobbies are created with.
+var gameConfig = config.Default().Game
 
-func addConnection(userID string, conn *websocket.Conn) {
-	connMutex.Lock()
-	defer connMutex.Unlock()
-	activeConnections[userID] = &SafeConnection{Conn: conn}
+// Configure sets the gameplay settings used by lobbies created from now on,
+// and by the tick and cleanup loops.
+func Configure(cfg config.GameConfig) {
+	gameConfig = cfg
 }
 
-var globalGameState = struct {
-	sync.RWMutex
-	Lobbies map[string]*GameState
-}{
-	Lobbies: make(map[string]*GameState),
+type GameState struct {
+	GameID       string        `json:"gameId"`
+	JoinCode     string        `json:"joinCode"`
+	Settings     LobbySettings `json:"settings"`
+	OwnerID      string        `json:"ownerId"`
+	Phase        string        `json:"phase"`
+	Players      []Player      `json:"players"`
+	Projectiles  []Projectile  `json:"projectiles"`
+	LastActivity uint64        // Tick of the last join, leave or disconnect
+	Tick         uint64        `json:"tick"` // Number of simulation steps run
+
+	config   config.GameConfig
+	commands chan command
+	done     chan struct{}
+	closed   bool
+
+	clock            clock.Clock
+	lastTick         time.Time
+	accumulator      time.Duration
+	projectileSerial uint64
+	history          *positionHistory
+	snapshots        *snapshotHistory
+	phaseTimed       bool
+	phaseDeadline    uint64
+	scoreboardDirty  bool
+	spread           *rand.Rand
+
+	// Socket that created the lobby, until it joins or closes
+	creator *connection.SafeConnection
+	// The server's settings, which weapon stats are relative to
+	defaults config.GameConfig
 }
 
-type GameState struct {
-	GameID       string       `json:"gameId"`
-	Players      []Player     `json:"players"`
-	Projectiles  []Projectile `json:"projectiles"`
-	LastActivity time.Time
+// nextProjectileID numbers projectiles per lobby so that a replay produces
+// the same ids.
+func (lobby *GameState) nextProjectileID() string {
+	lobby.projectileSerial++
+	return strconv.FormatUint(lobby.projectileSerial, 10)
 }
 
 type Player struct {
@@ -59,12 +81,70 @@ type Player struct {
 	MousePositionY  float64               `json:"mousePositionY"`
 	MousePositionX  float64               `json:"mousePositionX"`
 	Controls        types.PlayerDirection `json:"controls"`
+	Ping            float64               `json:"ping"` // Smoothed round-trip time in milliseconds
+	Connected       bool                  `json:"connected"`
+	Ready           bool                  `json:"ready"`
+	Score           int                   `json:"score"`
+	Stats           PlayerStats           `json:"stats"`
+	Team            int                   `json:"team"` // Zero outside team modes
+	Dead            bool                  `json:"dead"`
+	// Tick at which a dead player respawns, and until which a spawned player
+	// can't be hit
+	RespawnTick    uint64 `json:"respawnTick"`
+	ProtectedUntil uint64 `json:"protectedUntil"`
+	Weapon         string `json:"weapon"`
+	Ammo           int    `json:"ammo"`
+	// Tick at which the current reload finishes, zero when not reloading
+	ReloadTick uint64 `json:"reloadTick"`
+	// Sequence number of the last input applied, for client reconciliation
+	LastProcessedInput uint32 `json:"lastProcessedInput"`
+
+	// Tick at which a disconnected player is removed
+	removeTick    uint64
+	pendingInputs []PlayerInput
+	// Tick each opponent last damaged this player, for assists
+	damagedBy map[string]uint64
+	// Earliest tick the weapon can fire again, and the ammo left in the
+	// weapons not in hand
+	nextShotTick uint64
+	magazines    map[string]int
+
+	// Delta encoding of the game updates sent to this player
+	snapshotAck       uint64
+	keyframeTick      uint64
+	keyframeRequested bool
+}
+
+// findPlayer returns a pointer into the lobby's player slice, or nil.
+func (lobby *GameState) findPlayer(playerID string) *Player {
+	for i := range lobby.Players {
+		if lobby.Players[i].PlayerID == playerID {
+			return &lobby.Players[i]
+		}
+	}
+	return nil
 }
 
 type FrontendGameState struct {
-	GameID      string       `json:"gameId"`
-	Players     []Player     `json:"players"`
-	Projectiles []Projectile `json:"projectiles"`
+	GameID      string        `json:"gameId"`
+	JoinCode    string        `json:"joinCode"`
+	Settings    LobbySettings `json:"settings"`
+	OwnerID     string        `json:"ownerId"`
+	Phase       string        `json:"phase"`
+	Players     []Player      `json:"players"`
+	Projectiles []Projectile  `json:"projectiles"`
+}
+
+func (lobby *GameState) frontendState() FrontendGameState {
+	return FrontendGameState{
+		GameID:      lobby.GameID,
+		JoinCode:    lobby.JoinCode,
+		Settings:    lobby.Settings,
+		OwnerID:     lobby.OwnerID,
+		Phase:       lobby.Phase,
+		Players:     lobby.Players,
+		Projectiles: lobby.Projectiles,
+	}
 }
 
 type FrontendGameEnter struct {
@@ -79,44 +159,73 @@ type Projectile struct {
 	PositionY    float64 `json:"positionY"`
 	VelocityX    float64 `json:"velocityX"`
 	VelocityY    float64 `json:"velocityY"`
+
+	// Steps back in time that hits are checked at, for the shooter's latency
+	rewindSteps uint64
+	// Shooter's team when it was fired
+	team   int
+	damage float64
 }
 
 // Add this new constant at the top with other constants
 const (
 	PLAYER_DEATH_EVENT = "player_death"
-)
+	PLAYER_LEFT_EVENT  = "player_left"
+	GAME_UPDATE_EVENT  = "game_update"
 
-func CreateGame(c echo.Context, ws *websocket.Conn, requestData map[string]interface{}) error {
-	newLobby := &GameState{
-		GameID:      uuid.New().String(),
-		Players:     []Player{},
-		Projectiles: []Projectile{},
-	}
+	PLAYER_DISCONNECTED_EVENT = "player_disconnected"
+	PLAYER_RECONNECTED_EVENT  = "player_reconnected"
+)
 
-	globalGameState.Lock()
-	globalGameState.Lobbies[newLobby.GameID] = newLobby
-	globalGameState.Unlock()
+// CreateGameRequest is the initial settings of the new lobby.
+type CreateGameRequest struct {
+	SettingsRequest
+}
 
-	response := types.FrontendResponse{
-		ID:   "game_created",
-		Data: newLobby.GameID,
-	}
+type GameCreated struct {
+	LobbyID  string `json:"lobbyId"`
+	JoinCode string `json:"joinCode"`
+}
 
-	jsonResponse, err := json.Marshal(response)
+func CreateGame(ctx *router.Context, request CreateGameRequest) error {
+	passwordHash, err := request.hashPassword()
 	if err != nil {
-		return nil
+		return err
 	}
 
-	err = ws.WriteMessage(websocket.TextMessage, jsonResponse)
-	if err != nil {
+	newLobby := newGameState(gameConfig, gameClock)
+	// The lobby's goroutine is not running yet
+	if err := newLobby.applySettings(request.SettingsRequest, passwordHash); err != nil {
 		return err
 	}
-	return nil
+	newLobby.creator = ctx.Conn
+	registerLobby(newLobby)
+
+	// Hold ownership for the creator until they join or their socket closes
+	go func() {
+		<-ctx.Conn.Done()
+		newLobby.do(func(lobby *GameState) {
+			lobby.releaseCreator(ctx.Conn)
+		})
+	}()
+
+	response := types.FrontendResponse{
+		ID: "game_created",
+		Data: GameCreated{
+			LobbyID:  newLobby.GameID,
+			JoinCode: newLobby.JoinCode,
+		},
+	}
+
+	return ctx.Reply(response)
 }
 
+// LobbyRequest is sent with join_game. LobbyId may be the lobby's id or its
+// join code.
 type LobbyRequest struct {
 	LobbyId  string `json:"lobbyId"`
 	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 type LobbyResponse struct {
@@ -124,144 +233,331 @@ type LobbyResponse struct {
 	Players []Player `json:"players"`
 }
 
-func JoinGame(c echo.Context, ws *websocket.Conn, requestData map[string]interface{}) error {
+func JoinGame(ctx *router.Context, lobbyRequest LobbyRequest) error {
+	if lobbyRequest.LobbyId == "" {
+		return types.NewError(types.BadPayload, "lobby id not provided")
+	}
 
-	requestBytes, err := json.Marshal(requestData)
-	if err != nil {
-		return fmt.Errorf("error marshaling request data: %v", err)
+	if lobbyRequest.Username == "" {
+		return types.NewError(types.BadPayload, "username not provided")
 	}
 
-	var lobbyRequest LobbyRequest
-	if err := json.Unmarshal(requestBytes, &lobbyRequest); err != nil {
-		return fmt.Errorf("error unmarshaling into LobbyRequest: %v", err)
+	// A socket carries one lobby's updates, so it has to leave before joining
+	// another
+	if _, bound := ctx.Conn.Identity(); bound {
+		return types.NewError(types.AlreadyInLobby, "leave the current game first")
 	}
 
-	if lobbyRequest.LobbyId == "" {
-		return fmt.Errorf("lobby id not provided")
+	lobby, ok := findLobbyByIDOrCode(lobbyRequest.LobbyId)
+	if !ok {
+		return types.NewError(types.LobbyNotFound, "lobby %s not found", lobbyRequest.LobbyId)
 	}
 
-	if lobbyRequest.Username == "" {
-		return fmt.Errorf("username not provided")
+	// Compare the password here, bcrypt is too slow to run inside the lobby
+	var passwordHash []byte
+	if err := lobby.call(func(lobby *GameState) error {
+		passwordHash = lobby.Settings.passwordHash
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := checkPassword(passwordHash, lobbyRequest.Password); err != nil {
+		return err
 	}
 
 	playerId := uuid.New().String()
 
-	signedToken, err := authentication.GenerateToken(lobbyRequest.Username, lobbyRequest.LobbyId, playerId)
+	signedToken, err := authentication.GenerateToken(lobbyRequest.Username, lobby.GameID, playerId)
 	if err != nil {
-		return fmt.Errorf("failed to generate user token")
-	}
-
-	player := Player{
-		PlayerID:        playerId,
-		Username:        lobbyRequest.Username,
-		Health:          100,
-		PositionX:       500,
-		PositionY:       500,
-		TargetVelocityX: 0,
-		TargetVelocityY: 0,
-		VelocityX:       0,
-		VelocityY:       0,
-		Angle:           0,
-		MousePositionX:  0,
-		MousePositionY:  0,
-		Controls: types.PlayerDirection{
-			Up:    false,
-			Down:  false,
-			Left:  false,
-			Right: false,
-		},
+		return types.NewError(types.InternalError, "failed to generate user token")
 	}
 
-	globalGameState.Lock()
+	return lobby.call(func(lobby *GameState) error {
+		if len(lobby.Players) >= lobby.Settings.MaxPlayers {
+			return types.NewError(types.LobbyFull, "lobby is full")
+		}
 
-	if lobby, ok := globalGameState.Lobbies[lobbyRequest.LobbyId]; ok {
+		player := Player{
+			PlayerID:        playerId,
+			Username:        lobbyRequest.Username,
+			TargetVelocityX: 0,
+			TargetVelocityY: 0,
+			VelocityX:       0,
+			VelocityY:       0,
+			Angle:           0,
+			MousePositionX:  0,
+			MousePositionY:  0,
+			Connected:       true,
+			Controls: types.PlayerDirection{
+				Up:    false,
+				Down:  false,
+				Left:  false,
+				Right: false,
+			},
+		}
+		lobby.assignTeam(&player)
+		lobby.equip(&player, lobby.config.Weapons[0])
+		lobby.spawn(&player)
 		lobby.Players = append(lobby.Players, player)
-		response := types.FrontendResponse{
+		lobby.LastActivity = lobby.Tick
+		lobby.claimOwnership(ctx.Conn, &lobby.Players[len(lobby.Players)-1])
+		lobby.scoreboardDirty = true
+		lobby.publishSummary()
+
+		bindConnection(ctx.Conn, connection.Identity{
+			PlayerID: playerId,
+			GameID:   lobby.GameID,
+			Username: lobbyRequest.Username,
+			Token:    signedToken,
+		})
+		return ctx.Reply(types.FrontendResponse{
 			ID: "game_enter",
 			Data: FrontendGameEnter{
-				Token: signedToken,
-				GameState: FrontendGameState{
-					GameID:      lobbyRequest.LobbyId,
-					Players:     lobby.Players,
-					Projectiles: lobby.Projectiles,
-				},
+				Token:     signedToken,
+				GameState: lobby.frontendState(),
 			},
-		}
-		jsonResponse, err := json.Marshal(response)
-		if err != nil {
+		})
+	})
+}
+
+func PlayerUpdatePosition(ctx *router.Context, input PlayerInput) error {
+	identity := ctx.Identity
+	playerId := identity.PlayerID
+
+	lobby, ok := findLobby(identity.GameID)
+	if !ok {
+		return nil
+	}
+	if !ctx.Conn.Supports(protocol.FeatureInputSequencing) {
+		// Applied as soon as it arrives, like inputs from older clients
+		input.Sequence = 0
+	}
+	return lobby.call(func(lobby *GameState) error {
+		player := lobby.findPlayer(playerId)
+		if player == nil {
 			return nil
 		}
-		addConnection(playerId, ws)
-		err = ws.WriteMessage(websocket.TextMessage, jsonResponse)
-		if err != nil {
-			return err
+		player.acknowledgeSnapshot(input.AckTick, lobby.Tick)
+		// Inputs arrive every frame, so they are dropped without an error
+		// reply that would flood the client's queue. phase_changed tells it why.
+		if !lobby.canMove() {
+			return nil
 		}
-	} else {
-		c.Logger().Error("Problem")
-	}
-	globalGameState.Unlock()
-	updateLobbyActivity(lobbyRequest.LobbyId)
-	return nil
+		player.queueInput(input)
+		return nil
+	})
 }
 
-func PlayerUpdatePosition(c echo.Context, ws *websocket.Conn, requestData map[string]interface{}, tokenString string) error {
-	token, claims, err := authentication.ParseToken(tokenString)
-	if err != nil {
+// Authenticate binds the connection to the player named in a token. This is
+// the only point, besides join_game and resume_session, where a token is
+// verified; later messages are checked against the bound identity.
+func Authenticate(ctx *router.Context) error {
+	if err := attachSession(ctx.Conn, ctx.Request.Token, false); err != nil {
 		return err
 	}
-	if !token.Valid {
-		return fmt.Errorf("invalid token")
+	identity, _ := ctx.Conn.Identity()
+	return ctx.Reply(types.FrontendResponse{
+		ID: "authenticated",
+		Data: map[string]interface{}{
+			"playerId": identity.PlayerID,
+			"gameId":   identity.GameID,
+			"token":    identity.Token,
+		},
+	})
+}
+
+// ResumeSession rebinds a new socket to the player named in an existing token,
+// as long as the player is still held in their lobby.
+func ResumeSession(ctx *router.Context) error {
+	if err := attachSession(ctx.Conn, ctx.Request.Token, true); err != nil {
+		return err
 	}
-	up, ok := requestData["up"].(bool)
+	identity, _ := ctx.Conn.Identity()
+
+	lobby, ok := findLobby(identity.GameID)
 	if !ok {
-		return fmt.Errorf("up not provided")
+		return types.NewError(types.SessionExpired, "session expired")
 	}
+	return lobby.call(func(lobby *GameState) error {
+		return ctx.Reply(types.FrontendResponse{
+			ID: "game_enter",
+			Data: FrontendGameEnter{
+				Token:     identity.Token,
+				GameState: lobby.frontendState(),
+			},
+		})
+	})
+}
 
-	down, ok := requestData["down"].(bool)
-	if !ok {
-		return fmt.Errorf("up not provided")
+// attachSession verifies a token and binds the connection to its player. With
+// takeover set, a socket still holding the player is closed in favour of this
+// one; otherwise a player that is already connected is refused.
+func attachSession(conn *connection.SafeConnection, tokenString string, takeover bool) error {
+	token, claims, err := authentication.ParseToken(tokenString)
+	if err != nil || !token.Valid {
+		return types.NewError(types.InvalidToken, "invalid token")
 	}
 
-	left, ok := requestData["left"].(bool)
-	if !ok {
-		return fmt.Errorf("left not provided")
+	playerId := claims.PlayerID
+	gameId := claims.GameId
+
+	if identity, bound := conn.Identity(); bound && identity.PlayerID != playerId {
+		return types.NewError(types.AlreadyInLobby, "leave the current game first")
 	}
-	right, ok := requestData["right"].(bool)
-	if !ok {
-		return fmt.Errorf("left not provided")
+
+	signedToken, err := authentication.GenerateToken(claims.Username, gameId, playerId)
+	if err != nil {
+		return types.NewError(types.InternalError, "failed to generate user token")
 	}
 
-	mousePositionX, ok := requestData["mousePositionX"].(float64)
+	lobby, ok := findLobby(gameId)
 	if !ok {
-		c.Logger().Panic()
-		return fmt.Errorf("mouse x not provided")
+		return types.NewError(types.SessionExpired, "session expired")
 	}
 
-	mousePositionY, ok := requestData["mousePositionY"].(float64)
-	if !ok {
-		return fmt.Errorf("mouse y not provided")
+	return lobby.call(func(lobby *GameState) error {
+		player := lobby.findPlayer(playerId)
+		if player == nil {
+			return types.NewError(types.SessionExpired, "session expired")
+		}
+
+		// A half-open socket may still hold the player
+		connMutex.Lock()
+		previous, hadPrevious := activeConnections[playerId]
+		replaced := hadPrevious && previous != conn
+		if replaced && !takeover {
+			connMutex.Unlock()
+			return types.NewError(types.AlreadyConnected, "player already connected")
+		}
+		if replaced {
+			deleteConnection(gameId, playerId)
+		}
+		connMutex.Unlock()
+		if replaced {
+			previous.Unbind()
+			previous.Close(websocket.ClosePolicyViolation, "session resumed elsewhere")
+		}
+
+		wasConnected := player.Connected
+		player.Connected = true
+		// The new socket has none of the updates the old one acknowledged
+		player.snapshotAck = 0
+		player.keyframeRequested = true
+		if previous != conn {
+			// A new socket numbers its inputs from 1 again
+			player.LastProcessedInput = 0
+			player.pendingInputs = nil
+		}
+		lobby.LastActivity = lobby.Tick
+		bindConnection(conn, connection.Identity{
+			PlayerID: playerId,
+			GameID:   gameId,
+			Username: claims.Username,
+			Token:    signedToken,
+			// The token just verified stays valid without another check
+			AcceptedToken: tokenString,
+		})
+
+		if !wasConnected {
+			broadcastMessageToGameRoom(gameId, types.FrontendResponse{
+				ID: PLAYER_RECONNECTED_EVENT,
+				Data: map[string]interface{}{
+					"playerId": player.PlayerID,
+					"username": player.Username,
+				},
+			})
+		}
+		return nil
+	})
+}
+
+func LeaveGame(ctx *router.Context) error {
+	conn := ctx.Conn
+	identity := ctx.Identity
+	playerId := identity.PlayerID
+	gameId := identity.GameID
+
+	// Stop sending the lobby's updates to this socket before telling the others
+	connMutex.Lock()
+	if safeConn, ok := activeConnections[playerId]; ok && safeConn == conn {
+		deleteConnection(gameId, playerId)
 	}
-	playerId := claims.PlayerID
-	gameId := claims.GameId
+	connMutex.Unlock()
+	conn.Unbind()
 
-	globalGameState.Lock()
-	if lobby, ok := globalGameState.Lobbies[gameId]; ok {
-		// Iterate through players to find the matching one
-		for i := range lobby.Players {
-			if lobby.Players[i].PlayerID == playerId {
-				lobby.Players[i].Controls.Up = up
-				lobby.Players[i].Controls.Down = down
-				lobby.Players[i].Controls.Left = left
-				lobby.Players[i].Controls.Right = right
-				lobby.Players[i].MousePositionX = mousePositionX
-				lobby.Players[i].MousePositionY = mousePositionY
-				break
-			}
+	if lobby, ok := findLobby(gameId); ok {
+		lobby.call(func(lobby *GameState) error {
+			lobby.removePlayer(playerId)
+			return nil
+		})
+	}
+
+	return ctx.Reply(types.FrontendResponse{
+		ID:   "game_left",
+		Data: gameId,
+	})
+}
+
+// markPlayerDisconnected freezes a player whose socket went away. They are
+// removed once the reconnect grace period has passed unless the session is
+// resumed in time.
+func (lobby *GameState) markPlayerDisconnected(playerID string) {
+	lobby.do(func(lobby *GameState) {
+		player := lobby.findPlayer(playerID)
+		if player == nil {
+			return
+		}
+
+		player.Connected = false
+		player.removeTick = lobby.Tick + lobby.ticksFor(lobby.config.ReconnectGracePeriod.Duration)
+		player.Controls = types.PlayerDirection{}
+		player.pendingInputs = nil
+		lobby.LastActivity = lobby.Tick
+
+		broadcastMessageToGameRoom(lobby.GameID, types.FrontendResponse{
+			ID: PLAYER_DISCONNECTED_EVENT,
+			Data: map[string]interface{}{
+				"playerId": player.PlayerID,
+				"username": player.Username,
+			},
+		})
+	})
+}
+
+// removeDisconnected removes the players whose reconnect grace period is
+// over. It runs every step.
+func (lobby *GameState) removeDisconnected() {
+	for i := len(lobby.Players) - 1; i >= 0; i-- {
+		player := &lobby.Players[i]
+		if !player.Connected && lobby.Tick >= player.removeTick {
+			lobby.removePlayer(player.PlayerID)
 		}
 	}
-	globalGameState.Unlock()
+}
 
-	return nil
+// removePlayer takes a player out of the lobby and lets the remaining players know.
+func (lobby *GameState) removePlayer(playerID string) {
+	for i := range lobby.Players {
+		if lobby.Players[i].PlayerID == playerID {
+			player := lobby.Players[i]
+			lobby.Players = append(lobby.Players[:i], lobby.Players[i+1:]...)
+			lobby.LastActivity = lobby.Tick
+			lobby.scoreboardDirty = true
+			lobby.publishSummary()
+
+			broadcastMessageToGameRoom(lobby.GameID, types.FrontendResponse{
+				ID: PLAYER_LEFT_EVENT,
+				Data: map[string]interface{}{
+					"playerId": player.PlayerID,
+					"username": player.Username,
+				},
+			})
+			if player.PlayerID == lobby.OwnerID {
+				lobby.transferOwnership()
+			}
+			break
+		}
+	}
 }
 
 type Point struct {
@@ -269,63 +565,85 @@ type Point struct {
 	Y float64
 }
 
-func PlayerShootProjectile(c echo.Context, ws *websocket.Conn, requestData map[string]interface{}, tokenString string) error {
-	token, claims, err := authentication.ParseToken(tokenString)
-	if err != nil {
-		return err
-	}
-	if !token.Valid {
-		return fmt.Errorf("invalid token")
-	}
+// ShootRequest is sent with player_shoot_projectile. ViewTick is the tick of
+// the latest game_update the client had rendered when the player fired; if it
+// is missing the shooter's round-trip time is used instead.
+type ShootRequest struct {
+	ViewTick uint64 `json:"viewTick"`
+}
 
-	playerId := claims.PlayerID
-	gameId := claims.GameId
+func PlayerShootProjectile(ctx *router.Context, request ShootRequest) error {
+	identity := ctx.Identity
+	playerId := identity.PlayerID
+	gameId := identity.GameID
 
-	globalGameState.Lock()
-	defer globalGameState.Unlock()
-
-	if lobby, ok := globalGameState.Lobbies[gameId]; ok {
-		for i := range lobby.Players {
-			if lobby.Players[i].PlayerID == playerId {
-				player := &lobby.Players[i]
-				angle := player.Angle
-				x := player.PositionX
-				y := player.PositionY
-
-				// Define the tip of the triangle relative to the center of the spacecraft
-				triangleHeight := 30.0 // Distance from the center to the tip of the triangle
-				tipPosition := rotateAndTranslate(Point{X: 0, Y: -triangleHeight}, angle, x, y)
-
-				// Calculate projectile velocity towards the mouse position
-				projectileVelocity := calculateProjectileVelocity(
-					tipPosition.X,
-					tipPosition.Y,
-					player.MousePositionX,
-					player.MousePositionY,
-					13.0, // Speed of the projectile
-				)
-
-				// Create the projectile starting at the tip of the triangle
-				projectile := Projectile{
-					ProjectileID: uuid.New().String(),
-					PlayerID:     playerId,
-					PositionX:    tipPosition.X,
-					PositionY:    tipPosition.Y,
-					VelocityX:    projectileVelocity.X,
-					VelocityY:    projectileVelocity.Y,
-				}
+	lobby, ok := findLobby(gameId)
+	if !ok {
+		return types.NewError(types.LobbyNotFound, "lobby %s not found", gameId)
+	}
 
-				// Add projectile to the lobby
-				lobby.Projectiles = append(lobby.Projectiles, projectile)
+	return lobby.call(func(lobby *GameState) error {
+		if !lobby.canShoot() {
+			return invalidPhase("shoot", lobby.Phase)
+		}
+		player := lobby.findPlayer(playerId)
+		if player == nil {
+			return nil
+		}
+		if player.Dead {
+			return types.NewError(types.PlayerDead, "cannot shoot while dead")
+		}
+		weapon := lobby.currentWeapon(player)
+		if err := lobby.fire(player, weapon); err != nil {
+			return err
+		}
+		// Firing gives up spawn protection
+		player.ProtectedUntil = 0
+
+		angle := player.Angle
+		x := player.PositionX
+		y := player.PositionY
+
+		// Define the tip of the triangle relative to the center of the spacecraft
+		triangleHeight := 30.0 // Distance from the center to the tip of the triangle
+		tipPosition := rotateAndTranslate(Point{X: 0, Y: -triangleHeight}, angle, x, y)
+
+		// Calculate projectile velocity towards the mouse position
+		projectileVelocity := calculateProjectileVelocity(
+			tipPosition.X,
+			tipPosition.Y,
+			player.MousePositionX,
+			player.MousePositionY,
+			lobby.projectileSpeed(weapon),
+		)
+		if weapon.Spread > 0 {
+			deviation := (lobby.spread.Float64()*2 - 1) * weapon.Spread
+			projectileVelocity = rotateAndTranslate(projectileVelocity, deviation, 0, 0)
+		}
 
-				break
-			}
+		// Only clients that asked for lag compensation have their shots rewound
+		var rewindSteps uint64
+		if ctx.Conn.Supports(protocol.FeatureLagCompensation) {
+			rewindSteps = lobby.rewindSteps(playerId, request.ViewTick)
 		}
-	} else {
-		c.Logger().Error("Problem")
-	}
 
-	return nil
+		// Create the projectile starting at the tip of the triangle
+		projectile := Projectile{
+			ProjectileID: lobby.nextProjectileID(),
+			PlayerID:     playerId,
+			PositionX:    tipPosition.X,
+			PositionY:    tipPosition.Y,
+			VelocityX:    projectileVelocity.X,
+			VelocityY:    projectileVelocity.Y,
+			rewindSteps:  rewindSteps,
+			team:         player.Team,
+			damage:       lobby.damage(weapon),
+		}
+
+		// Add projectile to the lobby
+		lobby.Projectiles = append(lobby.Projectiles, projectile)
+		return nil
+	})
 }
 
 func calculateProjectileVelocity(originX, originY, targetX, targetY, speed float64) Point {
@@ -339,165 +657,119 @@ func calculateProjectileVelocity(originX, originY, targetX, targetY, speed float
 	}
 }
 
-// Example: When a player joins or leaves the lobby
-func updateLobbyActivity(lobbyID string) {
-	globalGameState.Lock()
-	if lobby, ok := globalGameState.Lobbies[lobbyID]; ok {
-		lobby.LastActivity = time.Now()
-	}
-	globalGameState.Unlock()
-}
-
-func StartLobbyCleanupTicker() {
-	ticker := time.NewTicker(1 * time.Minute) // Check every minute
-	go func() {
-		for range ticker.C {
-			cleanupLobbies()
+// timeScale converts a step's duration in seconds into simulation units.
+const timeScale = 10
+
+// step advances the simulation by one fixed interval. Given the same state and
+// inputs it always produces the same result.
+func (lobby *GameState) step() {
+	deltaTime := lobby.stepInterval().Seconds() * timeScale
+	lobby.Tick++
+	lobby.removeDisconnected()
+	canvasWidth := lobby.config.WorldWidth
+	canvasHeight := lobby.config.WorldHeight
+	acceleration := lobby.config.Acceleration
+	smoothing := lobby.config.Smoothing
+
+	// Update each player's state
+	for p := range lobby.Players {
+		player := &lobby.Players[p]
+		lobby.respawnIfDue(player)
+		lobby.finishReload(player)
+		player.consumeInput()
+		if player.Dead {
+			continue
 		}
-	}()
-}
 
-func cleanupLobbies() {
-	globalGameState.Lock()
-	defer globalGameState.Unlock()
-
-	for id, lobby := range globalGameState.Lobbies {
-		if time.Since(lobby.LastActivity) > 10*time.Minute && len(lobby.Players) == 0 {
-			// Lobby is inactive and has no players, remove it
-			delete(globalGameState.Lobbies, id)
-			fmt.Printf("Lobby %s removed due to inactivity\n", id)
+		// Update target velocity based on key presses
+		player.TargetVelocityY = 0
+		if player.Controls.Up {
+			player.TargetVelocityY = -acceleration
+		} else if player.Controls.Down {
+			player.TargetVelocityY = acceleration
 		}
-	}
-}
 
-func GameTick() {
-	ticker := time.NewTicker(16 * time.Millisecond) // Approximately 60 ticks per second
-	lastTick := time.Now()                          // Initialize lastTick to the current time
+		player.TargetVelocityX = 0
+		if player.Controls.Left {
+			player.TargetVelocityX = -acceleration
+		} else if player.Controls.Right {
+			player.TargetVelocityX = acceleration
+		}
 
-	canvasWidth := float64(2560)
-	canvasHeight := float64(1440)
+		// Smoothly interpolate towards the target velocity
+		player.VelocityY += (player.TargetVelocityY - player.VelocityY) * smoothing * deltaTime
+		player.VelocityX += (player.TargetVelocityX - player.VelocityX) * smoothing * deltaTime
 
-	// Define constants outside the loop to avoid recalculating them each tick
-	const acceleration = 33.0
-	const smoothing = 5.0
-	const damage = 10.0
+		// Update player position
+		player.PositionX += player.VelocityX * deltaTime
+		player.PositionY += player.VelocityY * deltaTime
 
-	go func() {
-		for range ticker.C {
-			now := time.Now()
-			deltaTime := now.Sub(lastTick).Seconds() * 10
-			lastTick = now
-
-			globalGameState.Lock()
-
-			// Iterate through all lobbies
-			for _, lobby := range globalGameState.Lobbies {
-				// Update each player's state
-				for p := range lobby.Players {
-					player := &lobby.Players[p]
-
-					// Update target velocity based on key presses
-					player.TargetVelocityY = 0
-					if player.Controls.Up {
-						player.TargetVelocityY = -acceleration
-					} else if player.Controls.Down {
-						player.TargetVelocityY = acceleration
-					}
+		// Clamp PositionX and PositionY
+		player.PositionX = clamp(player.PositionX, 0, canvasWidth)
+		player.PositionY = clamp(player.PositionY, 0, canvasHeight)
 
-					player.TargetVelocityX = 0
-					if player.Controls.Left {
-						player.TargetVelocityX = -acceleration
-					} else if player.Controls.Right {
-						player.TargetVelocityX = acceleration
-					}
+		// Update player rotation angle towards the mouse
+		player.Angle = calculateRotationAngle(player.PositionX, player.PositionY, player.MousePositionX, player.MousePositionY)
 
-					// Smoothly interpolate towards the target velocity
-					player.VelocityY += (player.TargetVelocityY - player.VelocityY) * smoothing * deltaTime
-					player.VelocityX += (player.TargetVelocityX - player.VelocityX) * smoothing * deltaTime
-
-					// Update player position
-					player.PositionX += player.VelocityX * deltaTime
-					player.PositionY += player.VelocityY * deltaTime
-
-					// Clamp PositionX and PositionY
-					player.PositionX = clamp(player.PositionX, 0, canvasWidth)
-					player.PositionY = clamp(player.PositionY, 0, canvasHeight)
-
-					// Update player rotation angle towards the mouse
-					player.Angle = calculateRotationAngle(player.PositionX, player.PositionY, player.MousePositionX, player.MousePositionY)
-
-					// Handle collisions with projectiles
-					indicesToRemove := map[int]bool{} // Store indices of projectiles to remove
-					for j := range lobby.Projectiles {
-						projectile := &lobby.Projectiles[j]
-
-						if isCollision(*player, *projectile) {
-							// Handle projectile hit
-							player.Health -= damage
-							fmt.Printf("Player %s hit! Health: %f\n", player.PlayerID, player.Health)
-
-							// Mark projectile for removal
-							indicesToRemove[j] = true
-
-							// Handle player death
-							if player.Health <= 0 {
-								fmt.Printf("Player %s is dead!\n", player.PlayerID)
-
-								// Send death notification
-								deathResponse := types.FrontendResponse{
-									ID: PLAYER_DEATH_EVENT,
-									Data: map[string]interface{}{
-										"playerId": player.PlayerID,
-										"username": player.Username,
-									},
-								}
-								broadcastMessageToGameRoom(lobby.GameID, deathResponse)
-
-								// Optional: Reset player or remove them from the game
-								player.Health = 100    // Reset health
-								player.PositionX = 500 // Reset position
-								player.PositionY = 500
-							}
-						}
-					}
+		// Handle collisions with projectiles
+		indicesToRemove := map[int]bool{} // Store indices of projectiles to remove
+		for j := range lobby.Projectiles {
+			projectile := &lobby.Projectiles[j]
 
-					// Remove the projectiles marked for deletion
-					lobby.Projectiles = removeProjectiles(lobby.Projectiles, indicesToRemove)
-				}
-
-				// Update projectile positions and remove if off-screen
-				indicesToRemove := map[int]bool{} // Store indices of projectiles to remove
-				for j := range lobby.Projectiles {
-					projectile := &lobby.Projectiles[j]
-
-					// Update projectile position
-					projectile.PositionX += projectile.VelocityX * deltaTime
-					projectile.PositionY += projectile.VelocityY * deltaTime
+			if !lobby.canHit(projectile, player) {
+				continue
+			}
 
-					// Check if the projectile is off-screen
-					if isProjectileOffScreen(projectile, canvasWidth, canvasHeight) {
-						indicesToRemove[j] = true
+			// Check against where the target was when the shooter fired
+			if isCollision(lobby.targetAt(player, projectile), *projectile, lobby.config) {
+				// Handle projectile hit
+				lobby.recordHit(player, projectile, projectile.damage)
+				player.Health -= projectile.damage
+				fmt.Printf("Player %s hit! Health: %f\n", player.PlayerID, player.Health)
+
+				// Mark projectile for removal
+				indicesToRemove[j] = true
+
+				// Handle player death
+				if player.Health <= 0 {
+					fmt.Printf("Player %s is dead!\n", player.PlayerID)
+					lobby.kill(player)
+
+					// Send death notification
+					deathResponse := types.FrontendResponse{
+						ID:   PLAYER_DEATH_EVENT,
+						Data: lobby.recordKill(player, projectile),
 					}
+					broadcastMessageToGameRoom(lobby.GameID, deathResponse)
 				}
+			}
+		}
 
-				// Remove the off-screen projectiles
-				lobby.Projectiles = removeProjectiles(lobby.Projectiles, indicesToRemove)
+		// Remove the projectiles marked for deletion
+		lobby.Projectiles = removeProjectiles(lobby.Projectiles, indicesToRemove)
+	}
 
-				// Broadcast updated game state to all players
-				broadcastGameState(lobby)
-			}
+	// Update projectile positions and remove if off-screen
+	indicesToRemove := map[int]bool{} // Store indices of projectiles to remove
+	for j := range lobby.Projectiles {
+		projectile := &lobby.Projectiles[j]
 
-			globalGameState.Unlock()
-		}
-	}()
-}
+		// Update projectile position
+		projectile.PositionX += projectile.VelocityX * deltaTime
+		projectile.PositionY += projectile.VelocityY * deltaTime
 
-func broadcastGameState(lobby *GameState) {
-	response := types.FrontendResponse{
-		ID:   "game_update",
-		Data: lobby,
+		// Check if the projectile is off-screen
+		if isProjectileOffScreen(projectile, canvasWidth, canvasHeight) {
+			indicesToRemove[j] = true
+		}
 	}
-	broadcastMessageToGameRoom(lobby.GameID, response)
+
+	// Remove the off-screen projectiles
+	lobby.Projectiles = removeProjectiles(lobby.Projectiles, indicesToRemove)
+
+	lobby.history.record(lobby.Tick, lobby.Players)
+	lobby.updatePhase()
+	lobby.closeIfIdle()
 }
 
 // Helper function to remove projectiles based on their indices
@@ -534,39 +806,6 @@ func calculateRotationAngle(triangleX, triangleY, mouseX, mouseY float64) float6
 	return math.Atan2(dy, dx) - math.Pi/2 + math.Pi
 }
 
-func broadcastMessageToGameRoom(gameID string, message types.FrontendResponse) {
-	jsonResponse, err := json.Marshal(message)
-	if err != nil {
-		log.Println("Error marshalling JSON:", err)
-		return
-	}
-
-	for _, safeConn := range activeConnections {
-		safeConn.Mutex.Lock() // Lock the connection-specific mutex
-		err := safeConn.Conn.WriteMessage(websocket.TextMessage, jsonResponse)
-		safeConn.Mutex.Unlock() // Unlock the connection-specific mutex
-
-		if err != nil {
-			log.Println("Error writing to WebSocket:", err)
-			removeConnection(safeConn)
-		}
-	}
-}
-
-func removeConnection(safeConn *SafeConnection) {
-	connMutex.Lock()
-	defer connMutex.Unlock()
-	// Find the connection in the map and remove it
-	for userID, conn := range activeConnections {
-		if conn == safeConn {
-			delete(activeConnections, userID)
-			break
-		}
-	}
-	// Safely close the connection
-	safeConn.Conn.Close()
-}
-
 func rotateAndTranslate(point Point, angle, centerX, centerY float64) Point {
 	// Precompute cosine and sine for the given angle
 	cosAngle := math.Cos(angle)
@@ -590,9 +829,9 @@ func calculateOffset(angle, distance, perpendicularDistance float64) Point {
 	}
 }
 
-func isCollision(player Player, projectile Projectile) bool {
-	playerRadius := 20.0    // example radius for player
-	projectileRadius := 5.0 // example radius for projectile
+func isCollision(player Player, projectile Projectile, cfg config.GameConfig) bool {
+	playerRadius := cfg.PlayerRadius
+	projectileRadius := cfg.ProjectileRadius
 
 	dx := player.PositionX - projectile.PositionX
 	dy := player.PositionY - projectile.PositionY
@@ -0,0 +1,260 @@
+package lobby
+
+import (
+	"myapp/src/router"
+	"myapp/src/types"
+	"time"
+)
+
+// Match phases. A lobby waits for enough ready players, counts down, plays
+// until the time or score limit, then shows the results before either a
+// rematch or closing.
+const (
+	PhaseWaiting    = "waiting"
+	PhaseCountdown  = "countdown"
+	PhaseInProgress = "in_progress"
+	PhaseEnded      = "ended"
+)
+
+const (
+	PHASE_CHANGED_EVENT = "phase_changed"
+	MATCH_RESULTS_EVENT = "match_results"
+)
+
+type PhaseChange struct {
+	Phase    string `json:"phase"`
+	Previous string `json:"previous"`
+	Tick     uint64 `json:"tick"`
+	// Tick at which the phase ends on its own, if it has a time limit
+	EndTick    uint64 `json:"endTick,omitempty"`
+	DurationMs int64  `json:"durationMs,omitempty"`
+}
+
+type MatchResults struct {
+	Standings []ScoreboardEntry `json:"standings"`
+	// Empty when the match ended in a draw
+	WinnerID string `json:"winnerId,omitempty"`
+
+	// Set instead of WinnerID in team modes
+	Teams       []TeamScore `json:"teams,omitempty"`
+	WinningTeam int         `json:"winningTeam,omitempty"`
+}
+
+// ticksFor converts a duration into a number of simulation steps.
+func (lobby *GameState) ticksFor(d time.Duration) uint64 {
+	return uint64(d / lobby.stepInterval())
+}
+
+// setPhase moves the lobby into a phase, which ends by itself after duration
+// if timed is set, and tells everyone.
+func (lobby *GameState) setPhase(phase string, duration time.Duration, timed bool) {
+	change := PhaseChange{
+		Phase:    phase,
+		Previous: lobby.Phase,
+		Tick:     lobby.Tick,
+	}
+	lobby.Phase = phase
+	lobby.phaseTimed = timed
+	lobby.phaseDeadline = 0
+	if timed {
+		lobby.phaseDeadline = lobby.Tick + lobby.ticksFor(duration)
+		change.EndTick = lobby.phaseDeadline
+		change.DurationMs = duration.Milliseconds()
+	}
+	lobby.publishSummary()
+
+	broadcastMessageToGameRoom(lobby.GameID, types.FrontendResponse{
+		ID:   PHASE_CHANGED_EVENT,
+		Data: change,
+	})
+}
+
+func (lobby *GameState) phaseExpired() bool {
+	return lobby.phaseTimed && lobby.Tick >= lobby.phaseDeadline
+}
+
+// updatePhase makes any transition that is due. It runs after every step.
+func (lobby *GameState) updatePhase() {
+	switch lobby.Phase {
+	case PhaseWaiting:
+		if lobby.readyToStart() {
+			lobby.freezePlayers()
+			lobby.setPhase(PhaseCountdown, lobby.config.CountdownDuration.Duration, true)
+		}
+	case PhaseCountdown:
+		if !lobby.readyToStart() {
+			lobby.setPhase(PhaseWaiting, 0, false)
+		} else if lobby.phaseExpired() {
+			lobby.startMatch()
+		}
+	case PhaseInProgress:
+		if lobby.matchOver() {
+			lobby.endMatch()
+		}
+	case PhaseEnded:
+		if lobby.phaseExpired() {
+			lobby.closeAfterResults()
+		}
+	}
+}
+
+// readyToStart reports whether enough connected players are in the lobby,
+// and whether all of them are ready if ready checks are on.
+func (lobby *GameState) readyToStart() bool {
+	connected := 0
+	for i := range lobby.Players {
+		player := &lobby.Players[i]
+		if !player.Connected {
+			continue
+		}
+		if lobby.config.RequireReady && !player.Ready {
+			return false
+		}
+		connected++
+	}
+	return connected >= lobby.config.MinPlayers
+}
+
+func (lobby *GameState) startMatch() {
+	lobby.Projectiles = lobby.Projectiles[:0]
+	for i := range lobby.Players {
+		lobby.spawn(&lobby.Players[i])
+	}
+	lobby.resetStats()
+	timeLimit := lobby.config.TimeLimit.Duration
+	lobby.setPhase(PhaseInProgress, timeLimit, timeLimit > 0)
+}
+
+func (lobby *GameState) matchOver() bool {
+	if lobby.phaseExpired() || len(lobby.Players) < lobby.config.MinPlayers {
+		return true
+	}
+	if lobby.config.ScoreLimit > 0 {
+		for _, team := range lobby.teamScores() {
+			if team.Score >= lobby.config.ScoreLimit {
+				return true
+			}
+		}
+		for i := range lobby.Players {
+			if lobby.Players[i].Team == 0 && lobby.Players[i].Score >= lobby.config.ScoreLimit {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (lobby *GameState) endMatch() {
+	lobby.Projectiles = lobby.Projectiles[:0]
+	lobby.freezePlayers()
+	for i := range lobby.Players {
+		lobby.Players[i].Ready = false
+	}
+	lobby.setPhase(PhaseEnded, lobby.config.ResultsDuration.Duration, true)
+
+	broadcastMessageToGameRoom(lobby.GameID, types.FrontendResponse{
+		ID:   MATCH_RESULTS_EVENT,
+		Data: lobby.results(),
+	})
+}
+
+func (lobby *GameState) results() MatchResults {
+	standings := lobby.scoreboard()
+	results := MatchResults{Standings: standings}
+	if teams := lobby.teamScores(); len(teams) > 0 {
+		results.Teams = teams
+		best := teams[0]
+		draw := false
+		for _, team := range teams[1:] {
+			if team.Score > best.Score {
+				best, draw = team, false
+			} else if team.Score == best.Score {
+				draw = true
+			}
+		}
+		if !draw {
+			results.WinningTeam = best.Team
+		}
+		return results
+	}
+	if len(standings) == 1 || len(standings) > 1 && standings[0].Score > standings[1].Score {
+		results.WinnerID = standings[0].PlayerID
+	}
+	return results
+}
+
+// closeAfterResults shuts the lobby down when nobody asked for a rematch.
+func (lobby *GameState) closeAfterResults() {
+	broadcastMessageToGameRoom(lobby.GameID, types.FrontendResponse{
+		ID:   LOBBY_CLOSED_EVENT,
+		Data: lobbyClosed(lobby.GameID),
+	})
+	lobby.closed = true
+	unregisterLobby(lobby)
+}
+
+// freezePlayers drops every player's controls so nobody keeps moving through
+// a phase that refuses input.
+func (lobby *GameState) freezePlayers() {
+	for i := range lobby.Players {
+		lobby.Players[i].Controls = types.PlayerDirection{}
+		lobby.Players[i].pendingInputs = nil
+	}
+}
+
+// canMove reports whether player inputs are accepted. Players can move around
+// while waiting for the match, but not during the countdown or the results.
+func (lobby *GameState) canMove() bool {
+	return lobby.Phase == PhaseWaiting || lobby.Phase == PhaseInProgress
+}
+
+func (lobby *GameState) canShoot() bool {
+	return lobby.Phase == PhaseInProgress
+}
+
+func invalidPhase(action, phase string) error {
+	return types.NewError(types.InvalidPhase, "cannot %s while the lobby is %s", action, phase)
+}
+
+type ReadyRequest struct {
+	Ready bool `json:"ready"`
+}
+
+// SetReady marks the player as ready, or not, for the match to start.
+func SetReady(ctx *router.Context, request ReadyRequest) error {
+	identity := ctx.Identity
+	lobby, ok := findLobby(identity.GameID)
+	if !ok {
+		return types.NewError(types.LobbyNotFound, "lobby %s not found", identity.GameID)
+	}
+	return lobby.call(func(lobby *GameState) error {
+		if lobby.Phase != PhaseWaiting && lobby.Phase != PhaseCountdown {
+			return invalidPhase("change readiness", lobby.Phase)
+		}
+		if player := lobby.findPlayer(identity.PlayerID); player != nil {
+			player.Ready = request.Ready
+		}
+		return nil
+	})
+}
+
+// Rematch lets the lobby owner take everyone back to waiting from the results
+// instead of closing the lobby.
+func Rematch(ctx *router.Context) error {
+	identity := ctx.Identity
+	lobby, ok := findLobby(identity.GameID)
+	if !ok {
+		return types.NewError(types.LobbyNotFound, "lobby %s not found", identity.GameID)
+	}
+	return lobby.call(func(lobby *GameState) error {
+		if lobby.OwnerID != identity.PlayerID {
+			return types.NewError(types.NotLobbyOwner, "only the lobby owner can start a rematch")
+		}
+		if lobby.Phase != PhaseEnded {
+			return invalidPhase("start a rematch", lobby.Phase)
+		}
+		lobby.resetStats()
+		lobby.setPhase(PhaseWaiting, 0, false)
+		return nil
+	})
+}
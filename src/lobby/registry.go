@@ -0,0 +1,140 @@
+package lobby
+
+import (
+	"encoding/json"
+	"log"
+	"myapp/src/connection"
+	"myapp/src/types"
+	"sync"
+	"time"
+)
+
+var (
+	activeConnections = make(map[string]*connection.SafeConnection)
+	// lobbyMembers maps a game id to the player ids connected to that lobby.
+	lobbyMembers = make(map[string]map[string]bool)
+	connMutex    sync.Mutex
+)
+
+func addConnection(gameID string, userID string, conn *connection.SafeConnection) {
+	connMutex.Lock()
+	defer connMutex.Unlock()
+	activeConnections[userID] = conn
+	if _, ok := lobbyMembers[gameID]; !ok {
+		lobbyMembers[gameID] = make(map[string]bool)
+	}
+	lobbyMembers[gameID][userID] = true
+}
+
+// bindConnection ties a connection to a player and registers it with the
+// player's lobby.
+func bindConnection(conn *connection.SafeConnection, identity connection.Identity) {
+	conn.Bind(identity)
+	addConnection(identity.GameID, identity.PlayerID, conn)
+}
+
+// deleteConnection removes a connection from the registry. connMutex must be held.
+func deleteConnection(gameID string, userID string) {
+	delete(activeConnections, userID)
+	if members, ok := lobbyMembers[gameID]; ok {
+		delete(members, userID)
+		if len(members) == 0 {
+			delete(lobbyMembers, gameID)
+		}
+	}
+}
+
+// lobbyConnections returns the connections of every member of a lobby.
+func lobbyConnections(gameID string) []*connection.SafeConnection {
+	connMutex.Lock()
+	defer connMutex.Unlock()
+	connections := make([]*connection.SafeConnection, 0, len(lobbyMembers[gameID]))
+	for userID := range lobbyMembers[gameID] {
+		if safeConn, ok := activeConnections[userID]; ok {
+			connections = append(connections, safeConn)
+		}
+	}
+	return connections
+}
+
+// playerRTT returns the smoothed round-trip time of a player's connection.
+func playerRTT(playerID string) time.Duration {
+	connMutex.Lock()
+	defer connMutex.Unlock()
+	if safeConn, ok := activeConnections[playerID]; ok {
+		return safeConn.RTT()
+	}
+	return 0
+}
+
+// playerConnection returns the connection a player is currently bound to.
+func playerConnection(playerID string) (*connection.SafeConnection, bool) {
+	connMutex.Lock()
+	defer connMutex.Unlock()
+	safeConn, ok := activeConnections[playerID]
+	return safeConn, ok
+}
+
+// Disconnect drops every registry entry that belongs to the given socket and
+// holds its players for the reconnect grace period before removing them from
+// their lobbies. It is called once the socket's read loop has ended.
+func Disconnect(conn *connection.SafeConnection) {
+	type membership struct{ gameID, playerID string }
+	var memberships []membership
+
+	connMutex.Lock()
+	for gameID, members := range lobbyMembers {
+		for userID := range members {
+			if activeConnections[userID] == conn {
+				memberships = append(memberships, membership{gameID: gameID, playerID: userID})
+			}
+		}
+	}
+	for _, m := range memberships {
+		deleteConnection(m.gameID, m.playerID)
+	}
+	connMutex.Unlock()
+	conn.Unbind()
+	unsubscribeLobbies(conn)
+
+	for _, m := range memberships {
+		if lobby, ok := findLobby(m.gameID); ok {
+			lobby.markPlayerDisconnected(m.playerID)
+		}
+	}
+}
+
+func broadcastMessageToGameRoom(gameID string, message types.FrontendResponse) {
+	jsonResponse, err := json.Marshal(message)
+	if err != nil {
+		log.Println("Error marshalling JSON:", err)
+		return
+	}
+
+	for _, safeConn := range lobbyConnections(gameID) {
+		if err := safeConn.Send(jsonResponse); err != nil {
+			log.Println("Error queueing message:", err)
+		}
+	}
+}
+
+// removeLobbyMembers drops the registry entries of a lobby that is being
+// removed and unbinds its members' connections, so they can join another.
+func removeLobbyMembers(gameID string) {
+	var connections []*connection.SafeConnection
+	connMutex.Lock()
+	for userID := range lobbyMembers[gameID] {
+		if safeConn, ok := activeConnections[userID]; ok {
+			connections = append(connections, safeConn)
+		}
+		delete(activeConnections, userID)
+	}
+	delete(lobbyMembers, gameID)
+	connMutex.Unlock()
+
+	for _, safeConn := range connections {
+		if identity, ok := safeConn.Identity(); ok && identity.GameID == gameID {
+			safeConn.Unbind()
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package lobby
+
+import (
+	"myapp/src/clock"
+	"myapp/src/config"
+	"myapp/src/connection"
+	"myapp/src/router"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// replayResult is what a replay leaves behind.
+type replayResult struct {
+	players     []Player
+	projectiles []Projectile
+	// Whether "b" was still in the lobby on the step before and after its
+	// reconnect grace period ran out
+	presentBeforeGrace bool
+	presentAfterGrace  bool
+}
+
+// replay runs a lobby on a manual clock through a fixed script of inputs,
+// shots and a disconnect, advancing the clock one tick at a time.
+func replay(t *testing.T) replayResult {
+	cfg := config.Default().Game
+	cfg.MinPlayers = 1
+	cfg.ScoreLimit = 0
+	cfg.TimeLimit = config.Duration{}
+	cfg.ReconnectGracePeriod = config.Duration{Duration: time.Second}
+	clk := clock.NewManual(time.Unix(0, 0))
+
+	lobby := newGameState(cfg, clk)
+	lobby.GameID = "replay"
+	lobby.spread = newSpreadSource(lobby.GameID)
+	lobby.Phase = PhaseInProgress
+	for _, id := range []string{"a", "b"} {
+		player := Player{PlayerID: id, Username: id, Connected: true}
+		lobby.equip(&player, cfg.Weapons[len(lobby.Players)])
+		lobby.spawn(&player)
+		lobby.Players = append(lobby.Players, player)
+	}
+	registerLobby(lobby)
+	defer unregisterLobby(lobby)
+	defer lobby.call(func(lobby *GameState) error {
+		lobby.closed = true
+		return nil
+	})
+
+	contexts := map[string]*router.Context{}
+	for _, id := range []string{"a", "b"} {
+		contexts[id] = &router.Context{
+			Conn:     &connection.SafeConnection{},
+			Identity: connection.Identity{PlayerID: id, GameID: lobby.GameID},
+		}
+	}
+	present := func(playerID string) bool {
+		found := false
+		lobby.call(func(lobby *GameState) error {
+			found = lobby.findPlayer(playerID) != nil
+			return nil
+		})
+		return found
+	}
+
+	const disconnectTick = 60
+	graceTicks := lobby.ticksFor(cfg.ReconnectGracePeriod.Duration)
+	var result replayResult
+	for tick := uint64(0); tick < 150; tick++ {
+		for i, id := range []string{"a", "b"} {
+			PlayerUpdatePosition(contexts[id], PlayerInput{
+				Sequence:       uint32(tick + 1),
+				Right:          (tick+uint64(i)*10)%40 < 20,
+				Left:           (tick+uint64(i)*10)%40 >= 20,
+				Down:           tick%30 < 10,
+				MousePositionX: 1200 - float64(i)*400,
+				MousePositionY: 300 + float64(tick),
+			})
+			if tick%(7+uint64(i)*4) == 0 {
+				PlayerShootProjectile(contexts[id], ShootRequest{ViewTick: tick})
+			}
+		}
+		if tick == disconnectTick {
+			lobby.markPlayerDisconnected("b")
+		}
+		switch tick {
+		case disconnectTick + graceTicks - 1:
+			result.presentBeforeGrace = present("b")
+		case disconnectTick + graceTicks + 1:
+			result.presentAfterGrace = present("b")
+		}
+
+		// Commands are queued in order, so once this one has run the step
+		// below sees all of the above
+		present("a")
+		clk.Advance(cfg.TickInterval.Duration)
+		for {
+			var current uint64
+			lobby.call(func(lobby *GameState) error {
+				current = lobby.Tick
+				return nil
+			})
+			if current == tick+1 {
+				break
+			}
+		}
+	}
+
+	lobby.call(func(lobby *GameState) error {
+		result.players = append([]Player(nil), lobby.Players...)
+		result.projectiles = append([]Projectile(nil), lobby.Projectiles...)
+		return nil
+	})
+	return result
+}
+
+func TestReplayIsDeterministic(t *testing.T) {
+	first := replay(t)
+	second := replay(t)
+
+	if len(first.projectiles) == 0 {
+		t.Fatal("replay left no projectiles to compare")
+	}
+	if !reflect.DeepEqual(first.players, second.players) {
+		t.Errorf("players differ between replays:\n%+v\n%+v", first.players, second.players)
+	}
+	if !reflect.DeepEqual(first.projectiles, second.projectiles) {
+		t.Errorf("projectiles differ between replays:\n%+v\n%+v", first.projectiles, second.projectiles)
+	}
+}
+
+func TestReconnectGraceFollowsLobbyClock(t *testing.T) {
+	result := replay(t)
+	if !result.presentBeforeGrace {
+		t.Error("disconnected player removed before the grace period ran out")
+	}
+	if result.presentAfterGrace {
+		t.Error("disconnected player still present after the grace period")
+	}
+}
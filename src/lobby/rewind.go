@@ -0,0 +1,97 @@
+package lobby
+
+// positionFrame is where every player was at the end of a simulation step.
+type positionFrame struct {
+	tick      uint64
+	positions map[string]Point
+}
+
+// positionHistory is a ring buffer of recent frames used to check shots
+// against where targets were when the shooter fired.
+type positionHistory struct {
+	frames []positionFrame
+	next   int
+	count  int
+}
+
+func newPositionHistory(size int) *positionHistory {
+	return &positionHistory{frames: make([]positionFrame, size)}
+}
+
+func (h *positionHistory) record(tick uint64, players []Player) {
+	frame := &h.frames[h.next]
+	if frame.positions == nil {
+		frame.positions = make(map[string]Point, len(players))
+	}
+	for id := range frame.positions {
+		delete(frame.positions, id)
+	}
+	frame.tick = tick
+	for i := range players {
+		frame.positions[players[i].PlayerID] = Point{X: players[i].PositionX, Y: players[i].PositionY}
+	}
+
+	h.next = (h.next + 1) % len(h.frames)
+	if h.count < len(h.frames) {
+		h.count++
+	}
+}
+
+// position returns where a player was at the given tick, or the oldest
+// position still held if the tick has already been overwritten.
+func (h *positionHistory) position(playerID string, tick uint64) (Point, bool) {
+	for i := 1; i <= h.count; i++ {
+		frame := &h.frames[(h.next-i+len(h.frames))%len(h.frames)]
+		if frame.tick > tick && i < h.count {
+			continue
+		}
+		point, ok := frame.positions[playerID]
+		return point, ok
+	}
+	return Point{}, false
+}
+
+// historySize is the number of frames needed to rewind by the configured
+// maximum.
+func (lobby *GameState) historySize() int {
+	stepInterval := lobby.stepInterval()
+	return int((lobby.config.MaxRewind.Duration+stepInterval-1)/stepInterval) + 1
+}
+
+// rewindSteps works out how far back a shot should be checked. A client that
+// reports the tick it was displaying is trusted up to MaxRewind; otherwise the
+// shooter's round-trip time is used.
+func (lobby *GameState) rewindSteps(playerID string, viewTick uint64) uint64 {
+	stepInterval := lobby.stepInterval()
+	maxSteps := uint64(lobby.config.MaxRewind.Duration / stepInterval)
+
+	var steps uint64
+	if viewTick > 0 && viewTick <= lobby.Tick {
+		steps = lobby.Tick - viewTick
+	} else {
+		steps = uint64((playerRTT(playerID) + stepInterval/2) / stepInterval)
+	}
+
+	if steps > maxSteps {
+		steps = maxSteps
+	}
+	return steps
+}
+
+// targetAt returns a copy of the player moved to where they were when the
+// projectile's shooter saw them.
+func (lobby *GameState) targetAt(player *Player, projectile *Projectile) Player {
+	target := *player
+	if projectile.rewindSteps == 0 || lobby.history == nil {
+		return target
+	}
+	var tick uint64
+	if lobby.Tick > projectile.rewindSteps {
+		tick = lobby.Tick - projectile.rewindSteps
+	}
+	if point, ok := lobby.history.position(player.PlayerID, tick); ok {
+		target.PositionX = point.X
+		target.PositionY = point.Y
+	}
+	return target
+}
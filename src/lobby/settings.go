@@ -0,0 +1,298 @@
+package lobby
+
+import (
+	"myapp/src/config"
+	"myapp/src/connection"
+	"myapp/src/router"
+	"myapp/src/types"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Game modes.
+const (
+	ModeFreeForAll = "free_for_all"
+	ModeTeams      = "teams"
+)
+
+const (
+	SETTINGS_UPDATED_EVENT = "settings_updated"
+	OWNER_CHANGED_EVENT    = "owner_changed"
+)
+
+const (
+	maxNameLength    = 32
+	maxLobbyCapacity = 64
+	// bcrypt ignores anything past 72 bytes
+	maxPasswordLength = 72
+)
+
+// LobbySettings describe a lobby to the players browsing for one and to the
+// players in it.
+type LobbySettings struct {
+	Name        string           `json:"name"`
+	MaxPlayers  int              `json:"maxPlayers"`
+	Public      bool             `json:"public"`
+	Mode        string           `json:"mode"`
+	HasPassword bool             `json:"hasPassword"`
+	Gameplay    GameplaySettings `json:"gameplay"`
+	Rules       CollisionRules   `json:"rules"`
+
+	passwordHash []byte
+}
+
+// GameplaySettings are the gameplay parameters a lobby owner may change. They
+// are copied into the lobby's config.
+type GameplaySettings struct {
+	Damage          float64         `json:"damage"`
+	MaxHealth       float64         `json:"maxHealth"`
+	ProjectileSpeed float64         `json:"projectileSpeed"`
+	Acceleration    float64         `json:"acceleration"`
+	ScoreLimit      int             `json:"scoreLimit"`
+	TimeLimit       config.Duration `json:"timeLimit"`
+}
+
+func gameplaySettings(cfg config.GameConfig) GameplaySettings {
+	return GameplaySettings{
+		Damage:          cfg.Damage,
+		MaxHealth:       cfg.MaxHealth,
+		ProjectileSpeed: cfg.ProjectileSpeed,
+		Acceleration:    cfg.Acceleration,
+		ScoreLimit:      cfg.ScoreLimit,
+		TimeLimit:       cfg.TimeLimit,
+	}
+}
+
+func defaultSettings(cfg config.GameConfig) LobbySettings {
+	return LobbySettings{
+		MaxPlayers: cfg.MaxPlayers,
+		Public:     true,
+		Mode:       ModeFreeForAll,
+		Gameplay:   gameplaySettings(cfg),
+		Rules:      gameModes[ModeFreeForAll].Rules,
+	}
+}
+
+// SettingsRequest is sent with create_game and update_settings. Fields that
+// are left out keep their current value. An empty password removes it.
+// Changing the mode resets the rules to the mode's own, before any rules in
+// the same request are applied.
+type SettingsRequest struct {
+	Name       *string          `json:"name"`
+	MaxPlayers *int             `json:"maxPlayers"`
+	Public     *bool            `json:"public"`
+	Password   *string          `json:"password"`
+	Mode       *string          `json:"mode"`
+	Gameplay   *GameplayRequest `json:"gameplay"`
+	Rules      *RulesRequest    `json:"rules"`
+}
+
+type GameplayRequest struct {
+	Damage          *float64         `json:"damage"`
+	MaxHealth       *float64         `json:"maxHealth"`
+	ProjectileSpeed *float64         `json:"projectileSpeed"`
+	Acceleration    *float64         `json:"acceleration"`
+	ScoreLimit      *int             `json:"scoreLimit"`
+	TimeLimit       *config.Duration `json:"timeLimit"`
+}
+
+// hashPassword hashes a requested password outside the lobby's goroutine, as
+// bcrypt is deliberately slow. It returns nil if the password is unchanged.
+func (request SettingsRequest) hashPassword() ([]byte, error) {
+	if request.Password == nil || *request.Password == "" {
+		return nil, nil
+	}
+	if len(*request.Password) > maxPasswordLength {
+		return nil, types.NewError(types.InvalidSettings, "password must be at most %d bytes", maxPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(*request.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, types.NewError(types.InternalError, "failed to hash password")
+	}
+	return hash, nil
+}
+
+// applySettings validates a request against the lobby and applies it. Nothing
+// is changed if any field is invalid.
+func (lobby *GameState) applySettings(request SettingsRequest, passwordHash []byte) error {
+	settings := lobby.Settings
+	cfg := lobby.config
+
+	if request.Name != nil {
+		name := strings.TrimSpace(*request.Name)
+		if name == "" || len(name) > maxNameLength {
+			return types.NewError(types.InvalidSettings, "name must be 1 to %d characters", maxNameLength)
+		}
+		settings.Name = name
+	}
+	if request.MaxPlayers != nil {
+		// A lobby that cannot hold enough players to start would wait forever
+		minCapacity := cfg.MinPlayers
+		if minCapacity < 1 {
+			minCapacity = 1
+		}
+		if *request.MaxPlayers < minCapacity || *request.MaxPlayers > maxLobbyCapacity {
+			return types.NewError(types.InvalidSettings, "max players must be %d to %d", minCapacity, maxLobbyCapacity)
+		}
+		if *request.MaxPlayers < len(lobby.Players) {
+			return types.NewError(types.InvalidSettings, "lobby already has %d players", len(lobby.Players))
+		}
+		settings.MaxPlayers = *request.MaxPlayers
+	}
+	if request.Public != nil {
+		settings.Public = *request.Public
+	}
+	if request.Mode != nil {
+		mode, ok := gameModes[*request.Mode]
+		if !ok {
+			return types.NewError(types.InvalidSettings, "unknown mode %q", *request.Mode)
+		}
+		if *request.Mode != settings.Mode {
+			settings.Mode = *request.Mode
+			settings.Rules = mode.Rules
+		}
+	}
+	if rules := request.Rules; rules != nil {
+		if rules.SelfHit != nil {
+			settings.Rules.SelfHit = *rules.SelfHit
+		}
+		if rules.FriendlyFire != nil {
+			settings.Rules.FriendlyFire = *rules.FriendlyFire
+		}
+	}
+	if request.Password != nil {
+		settings.passwordHash = passwordHash
+		settings.HasPassword = passwordHash != nil
+	}
+	if gameplay := request.Gameplay; gameplay != nil {
+		if gameplay.Damage != nil {
+			cfg.Damage = *gameplay.Damage
+		}
+		if gameplay.MaxHealth != nil {
+			cfg.MaxHealth = *gameplay.MaxHealth
+		}
+		if gameplay.ProjectileSpeed != nil {
+			cfg.ProjectileSpeed = *gameplay.ProjectileSpeed
+		}
+		if gameplay.Acceleration != nil {
+			cfg.Acceleration = *gameplay.Acceleration
+		}
+		if gameplay.ScoreLimit != nil {
+			cfg.ScoreLimit = *gameplay.ScoreLimit
+		}
+		if gameplay.TimeLimit != nil {
+			cfg.TimeLimit = *gameplay.TimeLimit
+		}
+		if err := cfg.Validate(); err != nil {
+			return types.NewError(types.InvalidSettings, "%v", err)
+		}
+		settings.Gameplay = gameplaySettings(cfg)
+	}
+
+	modeChanged := settings.Mode != lobby.Settings.Mode
+	lobby.Settings = settings
+	lobby.config = cfg
+	if modeChanged {
+		lobby.assignTeams()
+	}
+	return nil
+}
+
+// checkPassword compares a join request's password against the lobby's hash.
+func checkPassword(passwordHash []byte, password string) error {
+	if passwordHash == nil {
+		return nil
+	}
+	if password == "" {
+		return types.NewError(types.PasswordRequired, "lobby requires a password")
+	}
+	if bcrypt.CompareHashAndPassword(passwordHash, []byte(password)) != nil {
+		return types.NewError(types.WrongPassword, "wrong password")
+	}
+	return nil
+}
+
+// UpdateSettings lets the lobby owner change the lobby's settings before the
+// match starts.
+func UpdateSettings(ctx *router.Context, request SettingsRequest) error {
+	identity := ctx.Identity
+	lobby, ok := findLobby(identity.GameID)
+	if !ok {
+		return types.NewError(types.LobbyNotFound, "lobby %s not found", identity.GameID)
+	}
+
+	passwordHash, err := request.hashPassword()
+	if err != nil {
+		return err
+	}
+
+	return lobby.call(func(lobby *GameState) error {
+		if lobby.OwnerID != identity.PlayerID {
+			return types.NewError(types.NotLobbyOwner, "only the lobby owner can change settings")
+		}
+		if lobby.Phase != PhaseWaiting {
+			return invalidPhase("change settings", lobby.Phase)
+		}
+		if err := lobby.applySettings(request, passwordHash); err != nil {
+			return err
+		}
+		lobby.publishSummary()
+
+		broadcastMessageToGameRoom(lobby.GameID, types.FrontendResponse{
+			ID:   SETTINGS_UPDATED_EVENT,
+			Data: lobby.Settings,
+		})
+		return ctx.Reply(types.FrontendResponse{
+			ID:   "settings_saved",
+			Data: lobby.Settings,
+		})
+	})
+}
+
+// transferOwnership hands the lobby to the player who has been in it longest
+// once the owner leaves.
+func (lobby *GameState) transferOwnership() {
+	lobby.OwnerID = ""
+	if len(lobby.Players) == 0 {
+		return
+	}
+	lobby.setOwner(&lobby.Players[0])
+}
+
+// claimOwnership makes a joining player the owner if their socket created the
+// lobby. Until the creator joins or goes away nobody else can own it, so a
+// stranger who joins first cannot take over; after that the first player to
+// join does.
+func (lobby *GameState) claimOwnership(conn *connection.SafeConnection, player *Player) {
+	switch {
+	case lobby.creator != nil && lobby.creator == conn:
+		lobby.creator = nil
+		lobby.setOwner(player)
+	case lobby.creator == nil && lobby.OwnerID == "":
+		lobby.OwnerID = player.PlayerID
+	}
+}
+
+// releaseCreator stops holding the lobby for a creator whose socket closed
+// before they joined.
+func (lobby *GameState) releaseCreator(conn *connection.SafeConnection) {
+	if lobby.creator != conn {
+		return
+	}
+	lobby.creator = nil
+	if lobby.OwnerID == "" {
+		lobby.transferOwnership()
+	}
+}
+
+func (lobby *GameState) setOwner(owner *Player) {
+	lobby.OwnerID = owner.PlayerID
+	broadcastMessageToGameRoom(lobby.GameID, types.FrontendResponse{
+		ID: OWNER_CHANGED_EVENT,
+		Data: map[string]interface{}{
+			"playerId": owner.PlayerID,
+			"username": owner.Username,
+		},
+	})
+}
@@ -0,0 +1,52 @@
+package lobby
+
+import (
+	"myapp/src/connection"
+	"testing"
+)
+
+func TestClaimOwnership(t *testing.T) {
+	creator, stranger := &connection.SafeConnection{}, &connection.SafeConnection{}
+
+	lobby := newTestLobby(ModeFreeForAll, CollisionRules{})
+	lobby.creator = creator
+	lobby.Players = append(lobby.Players, testPlayer("stranger", 0, 0))
+	lobby.claimOwnership(stranger, &lobby.Players[0])
+	if lobby.OwnerID != "" {
+		t.Fatalf("stranger who joined before the creator became owner")
+	}
+	lobby.Players = append(lobby.Players, testPlayer("creator", 0, 0))
+	lobby.claimOwnership(creator, &lobby.Players[1])
+	if lobby.OwnerID != "creator" {
+		t.Fatalf("owner = %q, want the creator", lobby.OwnerID)
+	}
+
+	// A creator who never joins hands the lobby to whoever is there
+	lobby = newTestLobby(ModeFreeForAll, CollisionRules{})
+	lobby.creator = creator
+	lobby.Players = append(lobby.Players, testPlayer("stranger", 0, 0))
+	lobby.claimOwnership(stranger, &lobby.Players[0])
+	lobby.releaseCreator(creator)
+	if lobby.OwnerID != "stranger" {
+		t.Fatalf("owner = %q after the creator left, want the stranger", lobby.OwnerID)
+	}
+	lobby.Players = append(lobby.Players, testPlayer("late", 0, 0))
+	lobby.claimOwnership(&connection.SafeConnection{}, &lobby.Players[1])
+	if lobby.OwnerID != "stranger" {
+		t.Fatalf("owner = %q, a later join took over", lobby.OwnerID)
+	}
+}
+
+func TestMaxPlayersBelowMinPlayers(t *testing.T) {
+	lobby := newTestLobby(ModeFreeForAll, CollisionRules{})
+	lobby.config.MinPlayers = 2
+	for _, maxPlayers := range []int{0, 1} {
+		if err := lobby.applySettings(SettingsRequest{MaxPlayers: &maxPlayers}, nil); err == nil {
+			t.Errorf("max players %d accepted with min players 2", maxPlayers)
+		}
+	}
+	maxPlayers := 2
+	if err := lobby.applySettings(SettingsRequest{MaxPlayers: &maxPlayers}, nil); err != nil {
+		t.Errorf("max players 2: %v", err)
+	}
+}
@@ -0,0 +1,408 @@
+package lobby
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"myapp/src/connection"
+	"myapp/src/protocol"
+	"myapp/src/router"
+	"myapp/src/types"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// snapshotHistorySize is the number of broadcast snapshots kept as possible
+// baselines. A client whose last acknowledged snapshot is older gets a keyframe.
+const snapshotHistorySize = 64
+
+// PlayerState is the part of a Player that is sent in game updates. The id
+// must stay the first field.
+type PlayerState struct {
+	PlayerID           string  `json:"playerId"`
+	Username           string  `json:"username"`
+	Health             float64 `json:"health"`
+	PositionX          float64 `json:"positionX"`
+	PositionY          float64 `json:"positionY"`
+	VelocityX          float64 `json:"velocityX"`
+	VelocityY          float64 `json:"velocityY"`
+	Angle              float64 `json:"angle"`
+	Ping               float64 `json:"ping"`
+	Connected          bool    `json:"connected"`
+	LastProcessedInput uint32  `json:"lastProcessedInput"`
+	Ready              bool    `json:"ready"`
+	Score              int     `json:"score"`
+	Team               int     `json:"team"`
+	Dead               bool    `json:"dead"`
+	RespawnTick        uint64  `json:"respawnTick"`
+	ProtectedUntil     uint64  `json:"protectedUntil"`
+	Weapon             string  `json:"weapon"`
+	Ammo               int     `json:"ammo"`
+	ReloadTick         uint64  `json:"reloadTick"`
+}
+
+func (player *Player) state() PlayerState {
+	return PlayerState{
+		PlayerID:           player.PlayerID,
+		Username:           player.Username,
+		Health:             player.Health,
+		PositionX:          player.PositionX,
+		PositionY:          player.PositionY,
+		VelocityX:          player.VelocityX,
+		VelocityY:          player.VelocityY,
+		Angle:              player.Angle,
+		Ping:               player.Ping,
+		Connected:          player.Connected,
+		LastProcessedInput: player.LastProcessedInput,
+		Ready:              player.Ready,
+		Score:              player.Score,
+		Team:               player.Team,
+		Dead:               player.Dead,
+		RespawnTick:        player.RespawnTick,
+		ProtectedUntil:     player.ProtectedUntil,
+		Weapon:             player.Weapon,
+		Ammo:               player.Ammo,
+		ReloadTick:         player.ReloadTick,
+	}
+}
+
+// ProjectileState is the part of a Projectile that is sent in game updates.
+// The id must stay the first field.
+type ProjectileState struct {
+	ProjectileID string  `json:"projectileId"`
+	PlayerID     string  `json:"playerId"`
+	PositionX    float64 `json:"positionX"`
+	PositionY    float64 `json:"positionY"`
+	VelocityX    float64 `json:"velocityX"`
+	VelocityY    float64 `json:"velocityY"`
+}
+
+func (projectile *Projectile) state() ProjectileState {
+	return ProjectileState{
+		ProjectileID: projectile.ProjectileID,
+		PlayerID:     projectile.PlayerID,
+		PositionX:    projectile.PositionX,
+		PositionY:    projectile.PositionY,
+		VelocityX:    projectile.VelocityX,
+		VelocityY:    projectile.VelocityY,
+	}
+}
+
+// FieldChanges holds the fields of one player or projectile that differ from
+// the baseline. It is sent as an object with the entity's id and the changed
+// fields under their usual names.
+type FieldChanges struct {
+	ID string
+	// Bit i is set when field i of the state struct changed
+	Mask   uint64
+	Values []interface{}
+
+	names []string
+}
+
+func (changes FieldChanges) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	id, err := json.Marshal(changes.ID)
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteString(`{"` + changes.names[0] + `":`)
+	buf.Write(id)
+
+	value := 0
+	for i := 1; i < len(changes.names); i++ {
+		if changes.Mask&(1<<uint(i)) == 0 {
+			continue
+		}
+		encoded, err := json.Marshal(changes.Values[value])
+		if err != nil {
+			return nil, err
+		}
+		value++
+		buf.WriteString(`,"` + changes.names[i] + `":`)
+		buf.Write(encoded)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// stateFields lists the JSON names of a state struct's fields.
+type stateFields []string
+
+var (
+	playerStateFields     = stateFieldsOf(PlayerState{})
+	projectileStateFields = stateFieldsOf(ProjectileState{})
+)
+
+func stateFieldsOf(state interface{}) stateFields {
+	t := reflect.TypeOf(state)
+	names := make(stateFields, t.NumField())
+	for i := range names {
+		names[i] = strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+	}
+	return names
+}
+
+// diff compares two states of the same entity field by field.
+func (fields stateFields) diff(previous, current interface{}) FieldChanges {
+	previousValue := reflect.ValueOf(previous)
+	currentValue := reflect.ValueOf(current)
+	changes := FieldChanges{ID: currentValue.Field(0).String(), names: fields}
+	for i := 1; i < currentValue.NumField(); i++ {
+		value := currentValue.Field(i).Interface()
+		if previousValue.Field(i).Interface() != value {
+			changes.Mask |= 1 << uint(i)
+			changes.Values = append(changes.Values, value)
+		}
+	}
+	return changes
+}
+
+type PlayerUpdates struct {
+	Spawned   []PlayerState  `json:"spawned,omitempty"`
+	Changed   []FieldChanges `json:"changed,omitempty"`
+	Despawned []string       `json:"despawned,omitempty"`
+}
+
+type ProjectileUpdates struct {
+	Spawned   []ProjectileState `json:"spawned,omitempty"`
+	Changed   []FieldChanges    `json:"changed,omitempty"`
+	Despawned []string          `json:"despawned,omitempty"`
+}
+
+// SnapshotUpdate is the data of a game_update. A keyframe lists every player
+// and projectile as spawned; otherwise the update only holds what changed
+// since the Baseline tick.
+type SnapshotUpdate struct {
+	Tick        uint64            `json:"tick"`
+	Baseline    uint64            `json:"baseline,omitempty"`
+	Keyframe    bool              `json:"keyframe"`
+	Players     PlayerUpdates     `json:"players"`
+	Projectiles ProjectileUpdates `json:"projectiles"`
+}
+
+// snapshot is the state sent after a tick, kept so that later updates can be
+// sent as deltas against it.
+type snapshot struct {
+	tick            uint64
+	players         []PlayerState
+	projectiles     []ProjectileState
+	playerIndex     map[string]int
+	projectileIndex map[string]int
+}
+
+func (lobby *GameState) takeSnapshot() *snapshot {
+	s := &snapshot{
+		tick:            lobby.Tick,
+		players:         make([]PlayerState, len(lobby.Players)),
+		projectiles:     make([]ProjectileState, len(lobby.Projectiles)),
+		playerIndex:     make(map[string]int, len(lobby.Players)),
+		projectileIndex: make(map[string]int, len(lobby.Projectiles)),
+	}
+	for i := range lobby.Players {
+		s.players[i] = lobby.Players[i].state()
+		s.playerIndex[lobby.Players[i].PlayerID] = i
+	}
+	for i := range lobby.Projectiles {
+		s.projectiles[i] = lobby.Projectiles[i].state()
+		s.projectileIndex[lobby.Projectiles[i].ProjectileID] = i
+	}
+	return s
+}
+
+// delta describes the snapshot relative to a baseline, or as a keyframe if
+// there is none.
+func (s *snapshot) delta(baseline *snapshot) SnapshotUpdate {
+	update := SnapshotUpdate{Tick: s.tick}
+	if baseline == nil {
+		update.Keyframe = true
+		update.Players.Spawned = s.players
+		update.Projectiles.Spawned = s.projectiles
+		return update
+	}
+	update.Baseline = baseline.tick
+
+	for _, current := range s.players {
+		i, ok := baseline.playerIndex[current.PlayerID]
+		if !ok {
+			update.Players.Spawned = append(update.Players.Spawned, current)
+			continue
+		}
+		if changes := playerStateFields.diff(baseline.players[i], current); changes.Mask != 0 {
+			update.Players.Changed = append(update.Players.Changed, changes)
+		}
+	}
+	for _, previous := range baseline.players {
+		if _, ok := s.playerIndex[previous.PlayerID]; !ok {
+			update.Players.Despawned = append(update.Players.Despawned, previous.PlayerID)
+		}
+	}
+
+	for _, current := range s.projectiles {
+		i, ok := baseline.projectileIndex[current.ProjectileID]
+		if !ok {
+			update.Projectiles.Spawned = append(update.Projectiles.Spawned, current)
+			continue
+		}
+		if changes := projectileStateFields.diff(baseline.projectiles[i], current); changes.Mask != 0 {
+			update.Projectiles.Changed = append(update.Projectiles.Changed, changes)
+		}
+	}
+	for _, previous := range baseline.projectiles {
+		if _, ok := s.projectileIndex[previous.ProjectileID]; !ok {
+			update.Projectiles.Despawned = append(update.Projectiles.Despawned, previous.ProjectileID)
+		}
+	}
+	return update
+}
+
+// snapshotHistory is a ring buffer of the snapshots most recently sent.
+type snapshotHistory struct {
+	snapshots []*snapshot
+	next      int
+}
+
+func newSnapshotHistory(size int) *snapshotHistory {
+	return &snapshotHistory{snapshots: make([]*snapshot, size)}
+}
+
+func (h *snapshotHistory) add(s *snapshot) {
+	h.snapshots[h.next] = s
+	h.next = (h.next + 1) % len(h.snapshots)
+}
+
+func (h *snapshotHistory) find(tick uint64) *snapshot {
+	for _, s := range h.snapshots {
+		if s != nil && s.tick == tick {
+			return s
+		}
+	}
+	return nil
+}
+
+// acknowledgeSnapshot records the newest update a client has applied, which
+// later updates are encoded against.
+func (player *Player) acknowledgeSnapshot(tick, currentTick uint64) {
+	if tick > player.snapshotAck && tick <= currentTick {
+		player.snapshotAck = tick
+	}
+}
+
+// keyframeSteps is the number of steps between periodic keyframes.
+func (lobby *GameState) keyframeSteps() uint64 {
+	return uint64(lobby.config.KeyframeInterval.Duration / lobby.stepInterval())
+}
+
+// encodedUpdate identifies a game_update message that can be shared by every
+// player with the same baseline and encoding.
+type encodedUpdate struct {
+	baseline uint64
+	binary   bool
+}
+
+// broadcastGameState sends each player the latest snapshot, encoded against
+// the last one they acknowledged. Game updates supersede each other, so a slow
+// client only ever has the newest one waiting.
+func broadcastGameState(lobby *GameState) {
+	// Each connection is looked up once, as the ping goes into the snapshot
+	connections := make([]*connection.SafeConnection, len(lobby.Players))
+	for p := range lobby.Players {
+		player := &lobby.Players[p]
+		player.Ping = 0
+		if safeConn, ok := playerConnection(player.PlayerID); ok {
+			connections[p] = safeConn
+			player.Ping = float64(safeConn.RTT()) / float64(time.Millisecond)
+		}
+	}
+
+	current := lobby.takeSnapshot()
+	lobby.snapshots.add(current)
+
+	encoded := map[encodedUpdate][]byte{}
+	for p := range lobby.Players {
+		player := &lobby.Players[p]
+		safeConn := connections[p]
+		if !player.Connected || safeConn == nil {
+			continue
+		}
+
+		var baseline *snapshot
+		// Clients without delta snapshots get a keyframe every time
+		if !player.keyframeRequested && current.tick-player.keyframeTick < lobby.keyframeSteps() &&
+			safeConn.Supports(protocol.FeatureDeltaSnapshots) {
+			baseline = lobby.snapshots.find(player.snapshotAck)
+		}
+		var baselineTick uint64
+		if baseline != nil {
+			baselineTick = baseline.tick
+		} else {
+			player.keyframeTick = current.tick
+			player.keyframeRequested = false
+		}
+
+		key := encodedUpdate{baseline: baselineTick, binary: safeConn.Binary()}
+		message, ok := encoded[key]
+		if !ok {
+			update := current.delta(baseline)
+			if key.binary {
+				message = update.encodeBinary()
+			} else {
+				var err error
+				message, err = json.Marshal(types.FrontendResponse{
+					ID:   GAME_UPDATE_EVENT,
+					Data: update,
+				})
+				if err != nil {
+					log.Println("Error marshalling JSON:", err)
+					return
+				}
+			}
+			encoded[key] = message
+		}
+
+		if key.binary {
+			safeConn.SendState(websocket.BinaryMessage, message)
+		} else {
+			safeConn.SendState(websocket.TextMessage, message)
+		}
+	}
+}
+
+type SnapshotAckRequest struct {
+	Tick uint64 `json:"tick"`
+}
+
+// SnapshotAck acknowledges a game_update for clients that are not sending
+// inputs, which otherwise carry the acknowledgement.
+func SnapshotAck(ctx *router.Context, request SnapshotAckRequest) error {
+	identity := ctx.Identity
+	lobby, ok := findLobby(identity.GameID)
+	if !ok {
+		return nil
+	}
+	lobby.do(func(lobby *GameState) {
+		if player := lobby.findPlayer(identity.PlayerID); player != nil {
+			player.acknowledgeSnapshot(request.Tick, lobby.Tick)
+		}
+	})
+	return nil
+}
+
+// RequestKeyframe makes the next game_update sent to the client a keyframe,
+// for a client that has lost track of its baselines.
+func RequestKeyframe(ctx *router.Context) error {
+	identity := ctx.Identity
+	lobby, ok := findLobby(identity.GameID)
+	if !ok {
+		return types.NewError(types.LobbyNotFound, "lobby %s not found", identity.GameID)
+	}
+	lobby.do(func(lobby *GameState) {
+		if player := lobby.findPlayer(identity.PlayerID); player != nil {
+			player.keyframeRequested = true
+		}
+	})
+	return nil
+}
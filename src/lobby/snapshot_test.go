@@ -0,0 +1,99 @@
+package lobby
+
+import (
+	"encoding/json"
+	"fmt"
+	"myapp/src/types"
+	"testing"
+)
+
+// benchmarkLobby returns a lobby with 8 players and 20 projectiles, and the
+// snapshots one step apart that game updates are encoded from.
+func benchmarkLobby() (lobby *GameState, baseline, current *snapshot) {
+	lobby = newTestLobby(ModeFreeForAll, CollisionRules{})
+	for i := 0; i < 8; i++ {
+		player := testPlayer(fmt.Sprintf("00000000-0000-4000-8000-%012d", i), 0, 200+float64(i)*250)
+		player.Username = fmt.Sprintf("player%d", i)
+		player.Weapon = "blaster"
+		player.Ammo = 12
+		player.VelocityX = 1.5
+		player.Angle = float64(i) / 3
+		lobby.Players = append(lobby.Players, player)
+	}
+	for i := 0; i < 20; i++ {
+		lobby.Projectiles = append(lobby.Projectiles, Projectile{
+			ProjectileID: fmt.Sprint(i + 1),
+			PlayerID:     lobby.Players[i%8].PlayerID,
+			PositionX:    100 + float64(i)*100,
+			PositionY:    300,
+			VelocityX:    13,
+		})
+	}
+
+	lobby.Tick = 100
+	baseline = lobby.takeSnapshot()
+
+	// Everything moves, as it does between two steps of a busy match
+	lobby.Tick++
+	for i := range lobby.Players {
+		lobby.Players[i].PositionX += lobby.Players[i].VelocityX
+		lobby.Players[i].Angle += 0.01
+	}
+	for i := range lobby.Projectiles {
+		lobby.Projectiles[i].PositionX += lobby.Projectiles[i].VelocityX
+	}
+	current = lobby.takeSnapshot()
+	return lobby, baseline, current
+}
+
+func benchmarkJSON(b *testing.B, data func() interface{}) {
+	var message []byte
+	for i := 0; i < b.N; i++ {
+		var err error
+		message, err = json.Marshal(types.FrontendResponse{ID: GAME_UPDATE_EVENT, Data: data()})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(message)), "bytes/msg")
+}
+
+func benchmarkBinary(b *testing.B, update func() SnapshotUpdate) {
+	var message []byte
+	for i := 0; i < b.N; i++ {
+		message = update().encodeBinary()
+	}
+	b.ReportMetric(float64(len(message)), "bytes/msg")
+}
+
+// BenchmarkFullStateJSON encodes the whole game state the way game updates
+// were sent before delta snapshots.
+func BenchmarkFullStateJSON(b *testing.B) {
+	lobby, _, _ := benchmarkLobby()
+	b.ResetTimer()
+	benchmarkJSON(b, func() interface{} { return lobby.frontendState() })
+}
+
+func BenchmarkKeyframeJSON(b *testing.B) {
+	_, _, current := benchmarkLobby()
+	b.ResetTimer()
+	benchmarkJSON(b, func() interface{} { return current.delta(nil) })
+}
+
+func BenchmarkDeltaJSON(b *testing.B) {
+	_, baseline, current := benchmarkLobby()
+	b.ResetTimer()
+	benchmarkJSON(b, func() interface{} { return current.delta(baseline) })
+}
+
+func BenchmarkKeyframeBinary(b *testing.B) {
+	_, _, current := benchmarkLobby()
+	b.ResetTimer()
+	benchmarkBinary(b, func() SnapshotUpdate { return current.delta(nil) })
+}
+
+func BenchmarkDeltaBinary(b *testing.B) {
+	_, baseline, current := benchmarkLobby()
+	b.ResetTimer()
+	benchmarkBinary(b, func() SnapshotUpdate { return current.delta(baseline) })
+}
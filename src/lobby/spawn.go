@@ -0,0 +1,90 @@
+package lobby
+
+import (
+	"math"
+	"myapp/src/config"
+	"myapp/src/types"
+)
+
+const PLAYER_RESPAWN_EVENT = "player_respawn"
+
+type RespawnEvent struct {
+	PlayerID       string  `json:"playerId"`
+	Username       string  `json:"username"`
+	PositionX      float64 `json:"positionX"`
+	PositionY      float64 `json:"positionY"`
+	Tick           uint64  `json:"tick"`
+	ProtectedUntil uint64  `json:"protectedUntil"`
+}
+
+// spawnPoint picks the spawn point whose nearest living enemy is farthest
+// away. With no enemies about it is the first point, so that replays spawn
+// players in the same place.
+func (lobby *GameState) spawnPoint(player *Player) config.SpawnPoint {
+	points := lobby.config.SpawnPoints
+	best, bestDistance := points[0], -1.0
+	for _, point := range points {
+		nearest := math.Inf(1)
+		for i := range lobby.Players {
+			enemy := &lobby.Players[i]
+			if enemy.PlayerID == player.PlayerID || enemy.Dead || sameTeam(enemy.Team, player.Team) {
+				continue
+			}
+			nearest = math.Min(nearest, math.Hypot(enemy.PositionX-point.X, enemy.PositionY-point.Y))
+		}
+		if nearest > bestDistance {
+			best, bestDistance = point, nearest
+		}
+	}
+	return best
+}
+
+// spawn brings a player into play at full health and ammo, protected for a
+// moment.
+func (lobby *GameState) spawn(player *Player) {
+	point := lobby.spawnPoint(player)
+	player.PositionX = point.X
+	player.PositionY = point.Y
+	player.VelocityX = 0
+	player.VelocityY = 0
+	player.Health = lobby.config.MaxHealth
+	player.Dead = false
+	player.RespawnTick = 0
+	player.ProtectedUntil = lobby.Tick + lobby.ticksFor(lobby.config.SpawnProtection.Duration)
+	lobby.rearm(player)
+}
+
+// kill leaves a player dead until their respawn is due. Their inputs are
+// still acknowledged but do not move them.
+func (lobby *GameState) kill(player *Player) {
+	player.Health = 0
+	player.VelocityX = 0
+	player.VelocityY = 0
+	player.Controls = types.PlayerDirection{}
+	player.Dead = true
+	player.RespawnTick = lobby.Tick + lobby.ticksFor(lobby.config.RespawnDelay.Duration)
+	player.ProtectedUntil = 0
+}
+
+// respawnIfDue spawns a dead player again once their delay has passed.
+func (lobby *GameState) respawnIfDue(player *Player) {
+	if !player.Dead || lobby.Tick < player.RespawnTick {
+		return
+	}
+	lobby.spawn(player)
+	broadcastMessageToGameRoom(lobby.GameID, types.FrontendResponse{
+		ID: PLAYER_RESPAWN_EVENT,
+		Data: RespawnEvent{
+			PlayerID:       player.PlayerID,
+			Username:       player.Username,
+			PositionX:      player.PositionX,
+			PositionY:      player.PositionY,
+			Tick:           lobby.Tick,
+			ProtectedUntil: player.ProtectedUntil,
+		},
+	})
+}
+
+func (player *Player) protected(tick uint64) bool {
+	return tick < player.ProtectedUntil
+}
@@ -0,0 +1,155 @@
+package lobby
+
+import (
+	"math"
+	"myapp/src/types"
+	"sort"
+)
+
+const SCOREBOARD_EVENT = "scoreboard"
+
+// PlayerStats are a player's totals for the current match.
+type PlayerStats struct {
+	Kills       int     `json:"kills"`
+	Deaths      int     `json:"deaths"`
+	Assists     int     `json:"assists"`
+	DamageDealt float64 `json:"damageDealt"`
+	DamageTaken float64 `json:"damageTaken"`
+}
+
+// DeathEvent is the data of player_death, enough for a kill feed. The killer
+// is left out when a player dies to their own projectile.
+type DeathEvent struct {
+	PlayerID       string   `json:"playerId"`
+	Username       string   `json:"username"`
+	KillerID       string   `json:"killerId,omitempty"`
+	KillerUsername string   `json:"killerUsername,omitempty"`
+	Assists        []Assist `json:"assists,omitempty"`
+	Tick           uint64   `json:"tick"`
+	RespawnTick    uint64   `json:"respawnTick"`
+}
+
+type Assist struct {
+	PlayerID string `json:"playerId"`
+	Username string `json:"username"`
+}
+
+type ScoreboardEntry struct {
+	PlayerID string `json:"playerId"`
+	Username string `json:"username"`
+	Team     int    `json:"team,omitempty"`
+	Score    int    `json:"score"`
+	PlayerStats
+}
+
+// recordHit credits the damage a projectile did to its owner and remembers
+// the attacker for assists. Only the health the victim had left counts, and
+// damage to yourself or your team is only counted as taken.
+func (lobby *GameState) recordHit(victim *Player, projectile *Projectile, damage float64) {
+	dealt := math.Min(damage, math.Max(victim.Health, 0))
+	victim.Stats.DamageTaken += dealt
+	if attackerID := projectile.PlayerID; attackerID != victim.PlayerID && !sameTeam(projectile.team, victim.Team) {
+		if attacker := lobby.findPlayer(attackerID); attacker != nil {
+			attacker.Stats.DamageDealt += dealt
+		}
+		if victim.damagedBy == nil {
+			victim.damagedBy = make(map[string]uint64)
+		}
+		victim.damagedBy[attackerID] = lobby.Tick
+	}
+	lobby.scoreboardDirty = true
+}
+
+// recordKill credits a kill to the owner of the killing projectile, and an
+// assist to everyone else who damaged the victim within the assist window.
+// Killing a teammate is not credited.
+func (lobby *GameState) recordKill(victim *Player, projectile *Projectile) DeathEvent {
+	killerID := projectile.PlayerID
+	victim.Stats.Deaths++
+	event := DeathEvent{
+		PlayerID:    victim.PlayerID,
+		Username:    victim.Username,
+		Tick:        lobby.Tick,
+		RespawnTick: victim.RespawnTick,
+	}
+
+	if killerID != victim.PlayerID {
+		event.KillerID = killerID
+		if killer := lobby.findPlayer(killerID); killer != nil {
+			if !sameTeam(projectile.team, victim.Team) {
+				killer.Stats.Kills++
+				killer.Score++
+			}
+			event.KillerUsername = killer.Username
+		}
+	}
+
+	// Sorted so that replays credit assists in the same order
+	attackerIDs := make([]string, 0, len(victim.damagedBy))
+	for attackerID := range victim.damagedBy {
+		attackerIDs = append(attackerIDs, attackerID)
+	}
+	sort.Strings(attackerIDs)
+
+	window := lobby.ticksFor(lobby.config.AssistWindow.Duration)
+	for _, attackerID := range attackerIDs {
+		if attackerID == killerID || lobby.Tick-victim.damagedBy[attackerID] > window {
+			continue
+		}
+		if assister := lobby.findPlayer(attackerID); assister != nil {
+			assister.Stats.Assists++
+			event.Assists = append(event.Assists, Assist{
+				PlayerID: assister.PlayerID,
+				Username: assister.Username,
+			})
+		}
+	}
+	victim.damagedBy = nil
+	lobby.scoreboardDirty = true
+	return event
+}
+
+// resetStats clears everyone's score and totals for a new match.
+func (lobby *GameState) resetStats() {
+	for i := range lobby.Players {
+		lobby.Players[i].Score = 0
+		lobby.Players[i].Stats = PlayerStats{}
+		lobby.Players[i].damagedBy = nil
+	}
+	lobby.scoreboardDirty = true
+}
+
+// scoreboard ranks players by score, then by fewest deaths.
+func (lobby *GameState) scoreboard() []ScoreboardEntry {
+	entries := make([]ScoreboardEntry, len(lobby.Players))
+	for i := range lobby.Players {
+		player := &lobby.Players[i]
+		entries[i] = ScoreboardEntry{
+			PlayerID:    player.PlayerID,
+			Username:    player.Username,
+			Team:        player.Team,
+			Score:       player.Score,
+			PlayerStats: player.Stats,
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Score != entries[j].Score {
+			return entries[i].Score > entries[j].Score
+		}
+		return entries[i].Deaths < entries[j].Deaths
+	})
+	return entries
+}
+
+// broadcastScoreboard pushes the scoreboard if it changed since it was last
+// sent. It runs at most once per tick.
+func broadcastScoreboard(lobby *GameState) {
+	if !lobby.scoreboardDirty {
+		return
+	}
+	lobby.scoreboardDirty = false
+	broadcastMessageToGameRoom(lobby.GameID, types.FrontendResponse{
+		ID:   SCOREBOARD_EVENT,
+		Data: lobby.scoreboard(),
+	})
+}
@@ -0,0 +1,103 @@
+package lobby
+
+// CollisionRules decide which players a projectile can hit besides enemies.
+type CollisionRules struct {
+	// Whether players can hit themselves, e.g. by moving into their own shot
+	SelfHit bool `json:"selfHit"`
+	// Whether players can hit their own team. Only matters in team modes.
+	FriendlyFire bool `json:"friendlyFire"`
+}
+
+type RulesRequest struct {
+	SelfHit      *bool `json:"selfHit"`
+	FriendlyFire *bool `json:"friendlyFire"`
+}
+
+// gameMode describes how a mode splits players up, and the collision rules a
+// lobby gets when it switches to the mode.
+type gameMode struct {
+	Teams int
+	Rules CollisionRules
+}
+
+var gameModes = map[string]gameMode{
+	ModeFreeForAll: {},
+	ModeTeams:      {Teams: 2},
+}
+
+type TeamScore struct {
+	Team  int `json:"team"`
+	Score int `json:"score"`
+}
+
+// canHit reports whether a projectile may hit a player. A projectile carries
+// its shooter's team so that the rules still hold after the shooter leaves.
+// Dead and spawn-protected players can't be hit at all.
+func (lobby *GameState) canHit(projectile *Projectile, player *Player) bool {
+	if player.Dead || player.protected(lobby.Tick) {
+		return false
+	}
+	rules := lobby.Settings.Rules
+	if projectile.PlayerID == player.PlayerID {
+		return rules.SelfHit
+	}
+	if sameTeam(projectile.team, player.Team) {
+		return rules.FriendlyFire
+	}
+	return true
+}
+
+// sameTeam reports whether two team numbers are the same team. Zero is no
+// team.
+func sameTeam(a, b int) bool {
+	return a != 0 && a == b
+}
+
+// assignTeam puts a player on the smallest team, or on no team outside team
+// modes.
+func (lobby *GameState) assignTeam(player *Player) {
+	teams := gameModes[lobby.Settings.Mode].Teams
+	player.Team = 0
+	if teams == 0 {
+		return
+	}
+	sizes := make([]int, teams+1)
+	for i := range lobby.Players {
+		if team := lobby.Players[i].Team; &lobby.Players[i] != player && team > 0 && team <= teams {
+			sizes[team]++
+		}
+	}
+	player.Team = 1
+	for team := 2; team <= teams; team++ {
+		if sizes[team] < sizes[player.Team] {
+			player.Team = team
+		}
+	}
+}
+
+// assignTeams deals everyone out again after the mode changes.
+func (lobby *GameState) assignTeams() {
+	for i := range lobby.Players {
+		lobby.Players[i].Team = 0
+	}
+	for i := range lobby.Players {
+		lobby.assignTeam(&lobby.Players[i])
+	}
+	lobby.scoreboardDirty = true
+}
+
+// teamScores sums the score of each team, in team order. It is empty outside
+// team modes.
+func (lobby *GameState) teamScores() []TeamScore {
+	teams := gameModes[lobby.Settings.Mode].Teams
+	scores := make([]TeamScore, teams)
+	for i := range scores {
+		scores[i].Team = i + 1
+	}
+	for i := range lobby.Players {
+		if team := lobby.Players[i].Team; team > 0 && team <= teams {
+			scores[team-1].Score += lobby.Players[i].Score
+		}
+	}
+	return scores
+}
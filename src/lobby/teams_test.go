@@ -0,0 +1,167 @@
+package lobby
+
+import (
+	"myapp/src/clock"
+	"myapp/src/config"
+	"testing"
+	"time"
+)
+
+// newTestLobby returns an unregistered lobby in the middle of a match that
+// never ends by itself.
+func newTestLobby(mode string, rules CollisionRules) *GameState {
+	cfg := config.Default().Game
+	cfg.MinPlayers = 1
+	cfg.ScoreLimit = 0
+	cfg.TimeLimit = config.Duration{}
+	lobby := newGameState(cfg, clock.NewManual(time.Unix(0, 0)))
+	lobby.Settings.Mode = mode
+	lobby.Settings.Rules = rules
+	lobby.Phase = PhaseInProgress
+	return lobby
+}
+
+func testPlayer(id string, team int, x float64) Player {
+	return Player{PlayerID: id, Username: id, Team: team, Health: 100, PositionX: x, PositionY: 500, Connected: true}
+}
+
+// testProjectile sits still on top of x, so it hits whoever is there on the
+// next step.
+func testProjectile(shooterID string, team int, x float64) Projectile {
+	return Projectile{ProjectileID: "1", PlayerID: shooterID, PositionX: x, PositionY: 500, team: team, damage: 10}
+}
+
+func TestCanHit(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		rules      CollisionRules
+		projectile Projectile
+		target     Player
+		want       bool
+	}{
+		{"self hit off", ModeFreeForAll, CollisionRules{}, testProjectile("a", 0, 0), testPlayer("a", 0, 0), false},
+		{"self hit on", ModeFreeForAll, CollisionRules{SelfHit: true}, testProjectile("a", 0, 0), testPlayer("a", 0, 0), true},
+		{"enemy in free for all", ModeFreeForAll, CollisionRules{}, testProjectile("a", 0, 0), testPlayer("b", 0, 0), true},
+		{"friendly fire off", ModeTeams, CollisionRules{}, testProjectile("a", 1, 0), testPlayer("b", 1, 0), false},
+		{"friendly fire on", ModeTeams, CollisionRules{FriendlyFire: true}, testProjectile("a", 1, 0), testPlayer("b", 1, 0), true},
+		{"enemy team", ModeTeams, CollisionRules{}, testProjectile("a", 1, 0), testPlayer("b", 2, 0), true},
+		{"self hit off in teams", ModeTeams, CollisionRules{FriendlyFire: true}, testProjectile("a", 1, 0), testPlayer("a", 1, 0), false},
+		{"departed shooter, same team", ModeTeams, CollisionRules{}, testProjectile("gone", 1, 0), testPlayer("b", 1, 0), false},
+		{"departed shooter, other team", ModeTeams, CollisionRules{}, testProjectile("gone", 1, 0), testPlayer("b", 2, 0), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lobby := newTestLobby(tt.mode, tt.rules)
+			if got := lobby.canHit(&tt.projectile, &tt.target); got != tt.want {
+				t.Errorf("canHit = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanHitSkipsDeadAndProtected(t *testing.T) {
+	lobby := newTestLobby(ModeFreeForAll, CollisionRules{})
+	lobby.Tick = 10
+	projectile := testProjectile("a", 0, 0)
+
+	dead := testPlayer("b", 0, 0)
+	dead.Dead = true
+	if lobby.canHit(&projectile, &dead) {
+		t.Error("dead player was hittable")
+	}
+
+	protected := testPlayer("b", 0, 0)
+	protected.ProtectedUntil = 11
+	if lobby.canHit(&projectile, &protected) {
+		t.Error("spawn protected player was hittable")
+	}
+}
+
+// TestStepCollisions runs the collision loop with a shooter "a" at x=100 and a
+// target "b" at x=900, and a projectile resting on whichever the case aims at.
+func TestStepCollisions(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		rules       CollisionRules
+		shooterTeam int
+		targetTeam  int
+		shooterLeft bool
+		selfShot    bool
+		wantHit     bool
+		wantCredit  bool
+	}{
+		{name: "self hit off", mode: ModeFreeForAll, selfShot: true},
+		{name: "self hit on", mode: ModeFreeForAll, rules: CollisionRules{SelfHit: true}, selfShot: true, wantHit: true},
+		{name: "enemy", mode: ModeFreeForAll, wantHit: true, wantCredit: true},
+		{name: "friendly fire off", mode: ModeTeams, shooterTeam: 1, targetTeam: 1},
+		{name: "friendly fire on", mode: ModeTeams, rules: CollisionRules{FriendlyFire: true}, shooterTeam: 1, targetTeam: 1, wantHit: true},
+		{name: "enemy team", mode: ModeTeams, shooterTeam: 1, targetTeam: 2, wantHit: true, wantCredit: true},
+		{name: "departed shooter, same team", mode: ModeTeams, shooterTeam: 1, targetTeam: 1, shooterLeft: true},
+		{name: "departed shooter, other team", mode: ModeTeams, shooterTeam: 1, targetTeam: 2, shooterLeft: true, wantHit: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lobby := newTestLobby(tt.mode, tt.rules)
+			if !tt.shooterLeft {
+				lobby.Players = append(lobby.Players, testPlayer("a", tt.shooterTeam, 100))
+			}
+			lobby.Players = append(lobby.Players, testPlayer("b", tt.targetTeam, 900))
+
+			victimID, x := "b", 900.0
+			if tt.selfShot {
+				victimID, x = "a", 100.0
+			}
+			lobby.Projectiles = append(lobby.Projectiles, testProjectile("a", tt.shooterTeam, x))
+
+			lobby.step()
+
+			victim := lobby.findPlayer(victimID)
+			if hit := victim.Health < 100; hit != tt.wantHit {
+				t.Fatalf("hit = %v, want %v (health %v)", hit, tt.wantHit, victim.Health)
+			}
+			if removed := len(lobby.Projectiles) == 0; removed != tt.wantHit {
+				t.Errorf("projectile removed = %v, want %v", removed, tt.wantHit)
+			}
+			if tt.wantHit && victim.Stats.DamageTaken != 10 {
+				t.Errorf("damage taken = %v, want 10", victim.Stats.DamageTaken)
+			}
+			if shooter := lobby.findPlayer("a"); shooter != nil {
+				credited := shooter.Stats.DamageDealt > 0
+				if credited != tt.wantCredit {
+					t.Errorf("damage credited = %v, want %v", credited, tt.wantCredit)
+				}
+			}
+		})
+	}
+}
+
+func TestKillCredit(t *testing.T) {
+	tests := []struct {
+		name       string
+		targetTeam int
+		wantKills  int
+	}{
+		{"enemy", 2, 1},
+		{"teammate", 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lobby := newTestLobby(ModeTeams, CollisionRules{FriendlyFire: true})
+			lobby.Players = append(lobby.Players, testPlayer("a", 1, 100), testPlayer("b", tt.targetTeam, 900))
+			lobby.findPlayer("b").Health = 10
+			lobby.Projectiles = append(lobby.Projectiles, testProjectile("a", 1, 900))
+
+			lobby.step()
+
+			shooter, victim := lobby.findPlayer("a"), lobby.findPlayer("b")
+			if !victim.Dead || victim.Stats.Deaths != 1 {
+				t.Fatalf("victim dead = %v with %d deaths, want dead with 1", victim.Dead, victim.Stats.Deaths)
+			}
+			if shooter.Stats.Kills != tt.wantKills || shooter.Score != tt.wantKills {
+				t.Errorf("kills = %d, score = %d, want %d", shooter.Stats.Kills, shooter.Score, tt.wantKills)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package lobby
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"myapp/src/config"
+	"myapp/src/router"
+	"myapp/src/types"
+	"time"
+)
+
+type SwitchWeaponRequest struct {
+	Weapon string `json:"weapon"`
+}
+
+// newSpreadSource seeds a lobby's shot spread from its id, so that a replay of
+// the lobby spreads its shots the same way.
+func newSpreadSource(gameID string) *rand.Rand {
+	hash := fnv.New64a()
+	hash.Write([]byte(gameID))
+	return rand.New(rand.NewSource(int64(hash.Sum64())))
+}
+
+func (lobby *GameState) findWeapon(name string) (config.Weapon, bool) {
+	for _, weapon := range lobby.config.Weapons {
+		if weapon.Name == name {
+			return weapon, true
+		}
+	}
+	return config.Weapon{}, false
+}
+
+// currentWeapon returns the player's weapon, falling back to the first one if
+// it is no longer defined.
+func (lobby *GameState) currentWeapon(player *Player) config.Weapon {
+	if weapon, ok := lobby.findWeapon(player.Weapon); ok {
+		return weapon
+	}
+	return lobby.config.Weapons[0]
+}
+
+// projectileSpeed and damage take the lobby's gameplay settings for weapons
+// that don't set their own. Other weapons are scaled by the lobby's setting
+// relative to the server's, so an owner who doubles the damage doubles it for
+// every weapon.
+func (lobby *GameState) projectileSpeed(weapon config.Weapon) float64 {
+	if weapon.ProjectileSpeed > 0 {
+		return scaled(weapon.ProjectileSpeed, lobby.config.ProjectileSpeed, lobby.defaults.ProjectileSpeed)
+	}
+	return lobby.config.ProjectileSpeed
+}
+
+func (lobby *GameState) damage(weapon config.Weapon) float64 {
+	if weapon.Damage > 0 {
+		return scaled(weapon.Damage, lobby.config.Damage, lobby.defaults.Damage)
+	}
+	return lobby.config.Damage
+}
+
+func scaled(stat, setting, base float64) float64 {
+	if base == 0 {
+		return stat
+	}
+	return stat * setting / base
+}
+
+// equip puts a weapon in the player's hands. Each weapon keeps what was left
+// in its magazine while holstered, so switching doesn't skip a reload.
+func (lobby *GameState) equip(player *Player, weapon config.Weapon) {
+	if player.Weapon != "" {
+		if player.magazines == nil {
+			player.magazines = make(map[string]int)
+		}
+		player.magazines[player.Weapon] = player.Ammo
+	}
+	player.Weapon = weapon.Name
+	player.Ammo = weapon.MagazineSize
+	if ammo, ok := player.magazines[weapon.Name]; ok {
+		player.Ammo = ammo
+	}
+	player.ReloadTick = 0
+	if player.Ammo == 0 {
+		lobby.startReload(player, weapon)
+	}
+}
+
+// rearm refills every magazine, as when a player spawns.
+func (lobby *GameState) rearm(player *Player) {
+	player.magazines = nil
+	player.Ammo = lobby.currentWeapon(player).MagazineSize
+	player.ReloadTick = 0
+	player.nextShotTick = 0
+}
+
+// fire spends a round if the weapon is ready, and starts a reload once the
+// magazine is empty.
+func (lobby *GameState) fire(player *Player, weapon config.Weapon) error {
+	if player.ReloadTick != 0 {
+		return types.NewError(types.Reloading, "reloading until tick %d", player.ReloadTick)
+	}
+	if lobby.Tick < player.nextShotTick {
+		return types.NewError(types.WeaponCooldown, "%s can fire again at tick %d", weapon.Name, player.nextShotTick)
+	}
+	player.Ammo--
+	player.nextShotTick = lobby.Tick + lobby.cooldownTicks(weapon)
+	if player.Ammo <= 0 {
+		lobby.startReload(player, weapon)
+	}
+	return nil
+}
+
+// cooldownTicks is the number of steps between shots. It rounds up, so that a
+// weapon never fires faster than its fire rate, and is at least one step.
+func (lobby *GameState) cooldownTicks(weapon config.Weapon) uint64 {
+	cooldown := time.Duration(float64(time.Second) / weapon.FireRate)
+	step := lobby.stepInterval()
+	ticks := uint64((cooldown + step - 1) / step)
+	if ticks < 1 {
+		return 1
+	}
+	return ticks
+}
+
+func (lobby *GameState) startReload(player *Player, weapon config.Weapon) {
+	// Never zero, which means not reloading
+	player.ReloadTick = lobby.Tick + lobby.ticksFor(weapon.ReloadTime.Duration) + 1
+}
+
+// finishReload fills the magazine once a reload is done. It runs every step.
+func (lobby *GameState) finishReload(player *Player) {
+	if player.ReloadTick == 0 || lobby.Tick < player.ReloadTick {
+		return
+	}
+	player.Ammo = lobby.currentWeapon(player).MagazineSize
+	player.ReloadTick = 0
+}
+
+// SwitchWeapon equips one of the weapons in the game config.
+func SwitchWeapon(ctx *router.Context, request SwitchWeaponRequest) error {
+	identity := ctx.Identity
+	lobby, ok := findLobby(identity.GameID)
+	if !ok {
+		return types.NewError(types.LobbyNotFound, "lobby %s not found", identity.GameID)
+	}
+	return lobby.call(func(lobby *GameState) error {
+		weapon, ok := lobby.findWeapon(request.Weapon)
+		if !ok {
+			return types.NewError(types.UnknownWeapon, "unknown weapon %q", request.Weapon)
+		}
+		player := lobby.findPlayer(identity.PlayerID)
+		if player == nil || player.Weapon == weapon.Name {
+			return nil
+		}
+		lobby.equip(player, weapon)
+		return nil
+	})
+}
+
+// Reload starts reloading the player's weapon unless its magazine is full or
+// it is already reloading.
+func Reload(ctx *router.Context) error {
+	identity := ctx.Identity
+	lobby, ok := findLobby(identity.GameID)
+	if !ok {
+		return types.NewError(types.LobbyNotFound, "lobby %s not found", identity.GameID)
+	}
+	return lobby.call(func(lobby *GameState) error {
+		player := lobby.findPlayer(identity.PlayerID)
+		if player == nil || player.Dead || player.ReloadTick != 0 {
+			return nil
+		}
+		weapon := lobby.currentWeapon(player)
+		if player.Ammo < weapon.MagazineSize {
+			lobby.startReload(player, weapon)
+		}
+		return nil
+	})
+}
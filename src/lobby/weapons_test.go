@@ -0,0 +1,64 @@
+package lobby
+
+import (
+	"myapp/src/config"
+	"testing"
+)
+
+func TestCooldownTicks(t *testing.T) {
+	tests := []struct {
+		name     string
+		fireRate float64
+		want     uint64
+	}{
+		{"whole steps", 62.5, 1},
+		{"rounds up", 12, 6},
+		{"slow", 1.5, 42},
+		{"faster than a step", 1000, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lobby := newTestLobby(ModeFreeForAll, CollisionRules{})
+			if got := lobby.cooldownTicks(config.Weapon{FireRate: tt.fireRate}); got != tt.want {
+				t.Errorf("cooldownTicks = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFireCooldown(t *testing.T) {
+	lobby := newTestLobby(ModeFreeForAll, CollisionRules{})
+	weapon := config.Weapon{Name: "smg", FireRate: 12, MagazineSize: 30}
+	player := testPlayer("a", 0, 0)
+	player.Ammo = weapon.MagazineSize
+
+	if err := lobby.fire(&player, weapon); err != nil {
+		t.Fatalf("first shot: %v", err)
+	}
+	lobby.Tick += 5
+	if err := lobby.fire(&player, weapon); err == nil {
+		t.Fatal("fired again after 80ms, faster than 12 shots a second")
+	}
+	lobby.Tick++
+	if err := lobby.fire(&player, weapon); err != nil {
+		t.Fatalf("shot after the cooldown: %v", err)
+	}
+}
+
+func TestWeaponStatsFollowLobbySettings(t *testing.T) {
+	lobby := newTestLobby(ModeFreeForAll, CollisionRules{})
+	lobby.defaults.Damage, lobby.defaults.ProjectileSpeed = 10, 13
+	lobby.config.Damage, lobby.config.ProjectileSpeed = 20, 26
+
+	blaster := config.Weapon{Name: "blaster"}
+	rifle := config.Weapon{Name: "rifle", Damage: 35, ProjectileSpeed: 24}
+	if got := lobby.damage(blaster); got != 20 {
+		t.Errorf("blaster damage = %v, want the lobby's 20", got)
+	}
+	if got := lobby.damage(rifle); got != 70 {
+		t.Errorf("rifle damage = %v, want 70 with the lobby's damage doubled", got)
+	}
+	if got := lobby.projectileSpeed(rifle); got != 48 {
+		t.Errorf("rifle speed = %v, want 48 with the lobby's speed doubled", got)
+	}
+}
@@ -0,0 +1,231 @@
+// Package protocol holds the compact binary encoding that clients can choose
+// instead of JSON for the messages sent every tick.
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/google/uuid"
+)
+
+// Version is the protocol version this server speaks. Clients declaring a
+// version from MinVersion up to Version are accepted.
+const (
+	Version    = 1
+	MinVersion = 1
+)
+
+// Features the server can tell clients about in its hello reply.
+const (
+	FeatureDeltaSnapshots  = "delta_snapshots"
+	FeatureBinary          = "binary"
+	FeatureInputSequencing = "input_sequencing"
+	FeatureLagCompensation = "lag_compensation"
+)
+
+// Features lists every feature the server supports.
+var Features = []string{
+	FeatureDeltaSnapshots,
+	FeatureBinary,
+	FeatureInputSequencing,
+	FeatureLagCompensation,
+}
+
+// Negotiate returns the features that both the server and the client support,
+// in the server's order.
+func Negotiate(clientFeatures []string) []string {
+	features := []string{}
+	for _, feature := range Features {
+		for _, clientFeature := range clientFeatures {
+			if clientFeature == feature {
+				features = append(features, feature)
+				break
+			}
+		}
+	}
+	return features
+}
+
+// CloseUnsupportedVersion is the close code sent to clients whose protocol
+// version the server does not speak.
+const CloseUnsupportedVersion = 4001
+
+// Subprotocols a client can ask for in Sec-WebSocket-Protocol. A client that
+// asks for neither gets JSON.
+const (
+	JSON   = "shotball.json"
+	Binary = "shotball.binary"
+)
+
+var Subprotocols = []string{Binary, JSON}
+
+// The first byte of a binary frame says which message it holds.
+const (
+	OpPlayerInput     byte = 0x01
+	OpShootProjectile byte = 0x02
+	OpSnapshotAck     byte = 0x03
+	OpRequestKeyframe byte = 0x04
+
+	OpGameUpdate byte = 0x81
+)
+
+// Scales used to quantize floats. Positions are stored in sixteenths of a unit
+// and must lie within MaxPosition.
+const (
+	PositionScale = 16
+	VelocityScale = 100
+	HealthScale   = 10
+	MaxPosition   = math.MaxUint16 / PositionScale
+)
+
+var ErrShortMessage = errors.New("binary message too short")
+
+// Writer appends little-endian values to a buffer.
+type Writer struct {
+	buf []byte
+}
+
+func NewWriter(op byte) *Writer {
+	return &Writer{buf: []byte{op}}
+}
+
+func (w *Writer) Bytes() []byte {
+	return w.buf
+}
+
+func (w *Writer) Uint8(v uint8) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *Writer) Bool(v bool) {
+	if v {
+		w.Uint8(1)
+	} else {
+		w.Uint8(0)
+	}
+}
+
+func (w *Writer) Uint16(v uint16) {
+	w.buf = binary.LittleEndian.AppendUint16(w.buf, v)
+}
+
+func (w *Writer) Int16(v int16) {
+	w.Uint16(uint16(v))
+}
+
+func (w *Writer) Uint32(v uint32) {
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, v)
+}
+
+func (w *Writer) Uvarint(v uint64) {
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+// String writes a string of at most 255 bytes, truncating longer ones.
+func (w *Writer) String(v string) {
+	if len(v) > math.MaxUint8 {
+		v = v[:math.MaxUint8]
+	}
+	w.Uint8(uint8(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+// UUID writes a uuid string as its 16 raw bytes, or zeroes if it does not
+// parse.
+func (w *Writer) UUID(v string) {
+	id, _ := uuid.Parse(v)
+	w.buf = append(w.buf, id[:]...)
+}
+
+func (w *Writer) Position(v float64) {
+	w.Uint16(uint16(math.Round(clamp(v, 0, MaxPosition) * PositionScale)))
+}
+
+func (w *Writer) Velocity(v float64) {
+	w.Int16(int16(math.Round(clamp(v*VelocityScale, math.MinInt16, math.MaxInt16))))
+}
+
+// Angle writes an angle in radians as a fraction of a full turn.
+func (w *Writer) Angle(v float64) {
+	turn := math.Mod(v, 2*math.Pi)
+	if turn < 0 {
+		turn += 2 * math.Pi
+	}
+	w.Uint16(uint16(math.Round(turn / (2 * math.Pi) * math.MaxUint16)))
+}
+
+func (w *Writer) Health(v float64) {
+	w.Uint16(uint16(math.Round(clamp(v*HealthScale, 0, math.MaxUint16))))
+}
+
+// Reader reads little-endian values from a message. The first error is kept
+// and every later read returns a zero value, so callers check Err once.
+type Reader struct {
+	buf []byte
+	err error
+}
+
+func NewReader(payload []byte) *Reader {
+	return &Reader{buf: payload}
+}
+
+func (r *Reader) Err() error {
+	return r.err
+}
+
+func (r *Reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = ErrShortMessage
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *Reader) Uint8() uint8 {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *Reader) Uint16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *Reader) Uint32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *Reader) Uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = ErrShortMessage
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *Reader) Position() float64 {
+	return float64(r.Uint16()) / PositionScale
+}
+
+func clamp(value, min, max float64) float64 {
+	return math.Max(min, math.Min(max, value))
+}
@@ -0,0 +1,121 @@
+package router
+
+import (
+	"myapp/src/connection"
+	"myapp/src/types"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Recover turns a panicking handler into an error so one bad message cannot
+// take the server down.
+func Recover() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					ctx.Echo.Logger().Errorf("panic handling %s: %v\n%s", ctx.Request.ID, r, debug.Stack())
+					err = types.NewError(types.InternalError, "internal error handling %s", ctx.Request.ID)
+				}
+			}()
+			return next(ctx)
+		}
+	}
+}
+
+// Logger logs every message with how long it took to handle.
+func Logger() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			start := time.Now()
+			err := next(ctx)
+			if err != nil {
+				ctx.Echo.Logger().Debugf("ws %s failed after %s: %v", ctx.Request.ID, time.Since(start), err)
+			} else {
+				ctx.Echo.Logger().Debugf("ws %s handled in %s", ctx.Request.ID, time.Since(start))
+			}
+			return err
+		}
+	}
+}
+
+// RequireAuth rejects messages from connections that are not bound to a
+// player, or whose token does not match the bound player.
+func RequireAuth() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			identity, err := ctx.Conn.Authorize(ctx.Request.Token)
+			if err != nil {
+				return err
+			}
+			ctx.Identity = identity
+			return next(ctx)
+		}
+	}
+}
+
+// RequireHello rejects every message but the hello route from clients that
+// have not completed the handshake.
+func RequireHello(helloID string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			if _, ok := ctx.Conn.Handshake(); !ok && ctx.Request.ID != helloID {
+				return types.NewError(types.HelloRequired, "send %s before %s", helloID, ctx.Request.ID)
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// RateLimit allows each connection a sustained rate of messages per second
+// with bursts of up to burst messages.
+func RateLimit(rate float64, burst int) Middleware {
+	var mutex sync.Mutex
+	buckets := make(map[*connection.SafeConnection]*bucket)
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			mutex.Lock()
+			b, ok := buckets[ctx.Conn]
+			if !ok {
+				b = &bucket{tokens: float64(burst), last: time.Now()}
+				buckets[ctx.Conn] = b
+				// Forget the bucket once the connection is gone
+				conn := ctx.Conn
+				go func() {
+					<-conn.Done()
+					mutex.Lock()
+					delete(buckets, conn)
+					mutex.Unlock()
+				}()
+			}
+			allowed := b.take(rate, burst)
+			mutex.Unlock()
+
+			if !allowed {
+				return types.NewError(types.RateLimited, "rate limit exceeded")
+			}
+			return next(ctx)
+		}
+	}
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) take(rate float64, burst int) bool {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
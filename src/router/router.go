@@ -0,0 +1,175 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"myapp/src/connection"
+	"myapp/src/protocol"
+	"myapp/src/types"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Context carries a single websocket message through middleware to its handler.
+type Context struct {
+	Echo     echo.Context
+	Conn     *connection.SafeConnection
+	Request  types.FrontendRequest
+	Identity connection.Identity // Set by RequireAuth
+	// Payload is the already decoded data of a binary message
+	Payload interface{}
+}
+
+// Reply sends a direct reply to the message being handled, echoing its
+// correlation id.
+func (ctx *Context) Reply(response types.FrontendResponse) error {
+	response.RequestID = ctx.Request.RequestID
+	return ctx.Conn.SendJSON(response)
+}
+
+type HandlerFunc func(ctx *Context) error
+
+type Middleware func(next HandlerFunc) HandlerFunc
+
+type Router struct {
+	routes       map[string]HandlerFunc
+	binaryRoutes map[byte]binaryRoute
+	middleware   []Middleware
+}
+
+// binaryRoute maps a binary opcode onto a route registered by id.
+type binaryRoute struct {
+	id     string
+	decode func(r *protocol.Reader) interface{}
+}
+
+func New() *Router {
+	return &Router{
+		routes:       make(map[string]HandlerFunc),
+		binaryRoutes: make(map[byte]binaryRoute),
+	}
+}
+
+// Use adds middleware that wraps every route, in the order given. Middleware
+// must be added before routes are registered.
+func (r *Router) Use(middleware ...Middleware) {
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// HandleFunc registers a handler that takes no payload.
+func (r *Router) HandleFunc(id string, handler HandlerFunc, middleware ...Middleware) {
+	// Route middleware runs inside the router-wide middleware
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		handler = r.middleware[i](handler)
+	}
+	r.routes[id] = handler
+}
+
+// Handle registers a handler whose request data is decoded into T.
+func Handle[T any](r *Router, id string, handler func(ctx *Context, payload T) error, middleware ...Middleware) {
+	r.HandleFunc(id, func(ctx *Context) error {
+		var payload T
+		if decoded, ok := ctx.Payload.(T); ok {
+			payload = decoded
+		} else if len(ctx.Request.Data) > 0 {
+			if err := json.Unmarshal(ctx.Request.Data, &payload); err != nil {
+				return types.NewError(types.BadPayload, "bad payload for %s: %v", id, err)
+			}
+		}
+		return handler(ctx, payload)
+	}, middleware...)
+}
+
+// HandleBinary lets binary frames starting with opcode reach the route
+// registered for id, with their payload read by decode. Binary messages carry
+// no token or correlation id.
+func HandleBinary[T any](r *Router, opcode byte, id string, decode func(r *protocol.Reader) T) {
+	r.binaryRoutes[opcode] = binaryRoute{
+		id: id,
+		decode: func(r *protocol.Reader) interface{} {
+			return decode(r)
+		},
+	}
+}
+
+// Serve decodes a raw message and dispatches it. Handler errors are answered
+// with an error message; only fatal ones are returned, and the caller should
+// then close the connection.
+func (r *Router) Serve(c echo.Context, conn *connection.SafeConnection, msg []byte) error {
+	var request types.FrontendRequest
+	if err := json.Unmarshal(msg, &request); err != nil {
+		return replyError(c, conn, request, types.NewError(types.BadRequest, "message is not valid JSON"))
+	}
+
+	handler, found := r.routes[request.ID]
+	if !found {
+		return replyError(c, conn, request, types.NewError(types.UnknownMessage, "unhandled id %q", request.ID))
+	}
+
+	if err := handler(&Context{Echo: c, Conn: conn, Request: request}); err != nil {
+		return replyError(c, conn, request, err)
+	}
+	return nil
+}
+
+// ServeBinary decodes a binary frame and dispatches it like Serve. Binary
+// frames are only accepted from clients that negotiated the binary subprotocol.
+func (r *Router) ServeBinary(c echo.Context, conn *connection.SafeConnection, msg []byte) error {
+	if !conn.Binary() {
+		return replyError(c, conn, types.FrontendRequest{}, types.NewError(types.BadRequest, "binary messages need the %s subprotocol", protocol.Binary))
+	}
+	if len(msg) == 0 {
+		return replyError(c, conn, types.FrontendRequest{}, types.NewError(types.BadRequest, "empty binary message"))
+	}
+
+	route, found := r.binaryRoutes[msg[0]]
+	if !found {
+		return replyError(c, conn, types.FrontendRequest{}, types.NewError(types.UnknownMessage, "unhandled opcode %#x", msg[0]))
+	}
+	request := types.FrontendRequest{ID: route.id}
+
+	reader := protocol.NewReader(msg[1:])
+	payload := route.decode(reader)
+	if err := reader.Err(); err != nil {
+		return replyError(c, conn, request, types.NewError(types.BadPayload, "bad payload for %s: %v", route.id, err))
+	}
+
+	handler, found := r.routes[route.id]
+	if !found {
+		return replyError(c, conn, request, types.NewError(types.UnknownMessage, "unhandled id %q", route.id))
+	}
+
+	if err := handler(&Context{Echo: c, Conn: conn, Request: request, Payload: payload}); err != nil {
+		return replyError(c, conn, request, err)
+	}
+	return nil
+}
+
+// replyError sends an error message echoing the request's correlation id. It
+// returns the error if the connection should be closed.
+func replyError(c echo.Context, conn *connection.SafeConnection, request types.FrontendRequest, err error) error {
+	var requestErr *types.RequestError
+	if !errors.As(err, &requestErr) {
+		c.Logger().Error(err)
+		requestErr = types.NewError(types.InternalError, "internal error handling %s", request.ID)
+	}
+
+	if sendErr := conn.SendJSON(types.FrontendResponse{
+		ID:        "error",
+		RequestID: request.RequestID,
+		Data: types.ErrorResponse{
+			Code:    requestErr.Code,
+			Message: requestErr.Message,
+		},
+	}); sendErr != nil {
+		return sendErr
+	}
+
+	if requestErr.Fatal() {
+		return requestErr
+	}
+	return nil
+}
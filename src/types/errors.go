@@ -0,0 +1,66 @@
+package types
+
+import "fmt"
+
+// ErrorCode is a stable, machine-readable reason sent to clients in an error
+// message.
+type ErrorCode string
+
+const (
+	BadRequest         ErrorCode = "BAD_REQUEST"
+	BadPayload         ErrorCode = "BAD_PAYLOAD"
+	UnknownMessage     ErrorCode = "UNKNOWN_MESSAGE"
+	InvalidToken       ErrorCode = "INVALID_TOKEN"
+	NotAuthenticated   ErrorCode = "NOT_AUTHENTICATED"
+	IdentityMismatch   ErrorCode = "IDENTITY_MISMATCH"
+	SessionExpired     ErrorCode = "SESSION_EXPIRED"
+	AlreadyConnected   ErrorCode = "ALREADY_CONNECTED"
+	AlreadyInLobby     ErrorCode = "ALREADY_IN_LOBBY"
+	LobbyNotFound      ErrorCode = "LOBBY_NOT_FOUND"
+	LobbyFull          ErrorCode = "LOBBY_FULL"
+	PasswordRequired   ErrorCode = "PASSWORD_REQUIRED"
+	WrongPassword      ErrorCode = "WRONG_PASSWORD"
+	NotLobbyOwner      ErrorCode = "NOT_LOBBY_OWNER"
+	InvalidSettings    ErrorCode = "INVALID_SETTINGS"
+	InvalidPhase       ErrorCode = "INVALID_PHASE"
+	PlayerDead         ErrorCode = "PLAYER_DEAD"
+	UnknownWeapon      ErrorCode = "UNKNOWN_WEAPON"
+	WeaponCooldown     ErrorCode = "WEAPON_COOLDOWN"
+	Reloading          ErrorCode = "RELOADING"
+	RateLimited        ErrorCode = "RATE_LIMITED"
+	HelloRequired      ErrorCode = "HELLO_REQUIRED"
+	UnsupportedVersion ErrorCode = "UNSUPPORTED_VERSION"
+	InternalError      ErrorCode = "INTERNAL_ERROR"
+)
+
+// RequestError is returned by handlers for problems the client should be told
+// about.
+type RequestError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func NewError(code ErrorCode, format string, args ...interface{}) *RequestError {
+	return &RequestError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+// Fatal reports whether the error should close the connection. Only protocol
+// violations and bad or mismatched tokens do; a client that has not
+// authenticated yet may still do so.
+func (e *RequestError) Fatal() bool {
+	switch e.Code {
+	case BadRequest, InvalidToken, IdentityMismatch, UnsupportedVersion:
+		return true
+	}
+	return false
+}
+
+// ErrorResponse is the data of an "error" message.
+type ErrorResponse struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
@@ -1,16 +1,26 @@
 package types
 
-import "github.com/golang-jwt/jwt/v5"
+import (
+	"encoding/json"
 
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// FrontendRequest is a message from a client. RequestID is optional and is
+// echoed on every direct reply to the message.
 type FrontendRequest struct {
-	Token string      `json:"token"`
-	ID    string      `json:"id"`
-	Data  interface{} `json:"data"`
+	Token     string          `json:"token"`
+	ID        string          `json:"id"`
+	RequestID string          `json:"requestId,omitempty"`
+	Data      json.RawMessage `json:"data"`
 }
 
+// FrontendResponse is a message to a client. RequestID is only set on direct
+// replies; unsolicited pushes such as game_update leave it empty.
 type FrontendResponse struct {
-	ID   string      `json:"id"`
-	Data interface{} `json:"data"`
+	ID        string      `json:"id"`
+	RequestID string      `json:"requestId,omitempty"`
+	Data      interface{} `json:"data"`
 }
 
 type LoginData struct {